@@ -3,19 +3,31 @@ package auth
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go-pkgdl/helpers"
+	"go-pkgdl/logging"
+	"go-pkgdl/metrics"
+	"go-pkgdl/ratelimit"
+	"go-pkgdl/stats"
+	"hash"
 	"io"
 	"io/ioutil"
+	mathrand "math/rand"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -27,32 +39,140 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 )
 
-//Creds struct for creating download.json
+//Creds struct for creating download.json. Without a Username, Apikey is an access token sent as a bearer token
 type Creds struct {
-	URL        string
-	Username   string
-	Apikey     string
-	DlLocation string
+	URL          string
+	Username     string
+	Apikey       string
+	DlLocation   string
+	Token        string `json:",omitempty"`
+	RefreshToken string `json:",omitempty"`
 }
 
-//StorageDataJSON storage summary JSON
+//StorageDataJSON storage summary JSON. Current versions return the summaries at the top level, older ones wrapped in storageSummary
 type StorageDataJSON struct {
-	StorageSummary struct {
-		FileStoreSummary struct {
-			UsedSpace string `json:"usedSpace"`
-			FreeSpace string `json:"freeSpace"`
-		} `json:"fileStoreSummary"`
-		RepositoriesSummaryList []struct {
-			RepoKey string `json:"repoKey"`
-		} `json: "repositoriesSummaryList"`
-	} `json:"storageSummary"`
+	storageSummaryJSON
+	StorageSummary storageSummaryJSON `json:"storageSummary"`
+}
+
+type storageSummaryJSON struct {
+	FileStoreSummary struct {
+		UsedSpace         string `json:"usedSpace"`
+		FreeSpace         string `json:"freeSpace"`
+		TotalSpace        string `json:"totalSpace"`
+		UsedSpaceInBytes  int64  `json:"usedSpaceInBytes"`
+		TotalSpaceInBytes int64  `json:"totalSpaceInBytes"`
+	} `json:"fileStoreSummary"`
+	RepositoriesSummaryList []struct {
+		RepoKey          string `json:"repoKey"`
+		UsedSpace        string `json:"usedSpace"`
+		UsedSpaceInBytes int64  `json:"usedSpaceInBytes"`
+	} `json:"repositoriesSummaryList"`
+}
+
+//StatusError unexpected HTTP status code received from a request
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	if e.StatusCode == 0 {
+		return e.Method + " " + e.URL + " got no response"
+	}
+	return e.Method + " " + e.URL + " returned " + strconv.Itoa(e.StatusCode)
+}
+
+//Status path of the request and the status code it got, for tallying failures
+func (e *StatusError) Status() (string, int) {
+	if parsed, err := url.Parse(e.URL); err == nil && parsed.Path != "" {
+		return parsed.Path, e.StatusCode
+	}
+	return e.URL, e.StatusCode
+}
+
+//Checksum expected digest of a download, Algorithm being md5, sha1, sha256 or sha512. The zero value expects nothing
+type Checksum struct {
+	Algorithm string
+	Value     string
+}
+
+func (c Checksum) newHash() hash.Hash {
+	if c.Value == "" {
+		return nil
+	}
+	switch strings.ToLower(c.Algorithm) {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+//Matches whether r hashes to the checksum. An unknown or empty checksum matches nothing
+func (c Checksum) Matches(r io.Reader) bool {
+	h := c.newHash()
+	if h == nil {
+		return false
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return false
+	}
+	return strings.EqualFold(hex.EncodeToString(h.Sum(nil)), c.Value)
+}
+
+//HeaderChecksum strongest checksum in Artifactory's X-Checksum headers, the zero value if there is none
+func HeaderChecksum(header http.Header) Checksum {
+	for _, algorithm := range []string{"Sha256", "Sha1", "Md5"} {
+		if value := header.Get("X-Checksum-" + algorithm); value != "" {
+			return Checksum{Algorithm: strings.ToLower(algorithm), Value: value}
+		}
+	}
+	return Checksum{}
+}
+
+//ChecksumError download that didn't hash to what was expected
+type ChecksumError struct {
+	URL      string
+	Expected Checksum
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return "GET " + e.URL + " " + e.Expected.Algorithm + " mismatch, expected " + e.Expected.Value + " got " + e.Actual
+}
+
+//Mismatch path of the download, for tallying checksum failures
+func (e *ChecksumError) Mismatch() string {
+	if parsed, err := url.Parse(e.URL); err == nil && parsed.Path != "" {
+		return parsed.Path
+	}
+	return e.URL
+}
+
+//CheckStatus return a *StatusError unless the status code is 2xx
+func CheckStatus(method, urlInput string, statusCode int) error {
+	if statusCode >= 200 && statusCode < 300 {
+		return nil
+	}
+	return &StatusError{Method: method, URL: urlInput, StatusCode: statusCode}
 }
 
 // VerifyAPIKey for errors
 func VerifyAPIKey(urlInput, userName, apiKey string) bool {
-	log.Debug("starting VerifyAPIkey request. Testing:", userName)
+	if userName == "" {
+		log.Debug("starting VerifyAPIkey request. Testing access token")
+	} else {
+		log.Debug("starting VerifyAPIkey request. Testing:", userName)
+	}
 	//TODO need to sanitize invalid url strings, esp in custom flag
-	data, _, _ := GetRestAPI("GET", true, urlInput+"/api/system/ping", userName, apiKey, "", nil, 1)
+	data, _, _ := GetRestAPI(context.Background(), "GET", true, urlInput+"/api/system/ping", userName, apiKey, "", nil, 1)
 	if string(data) == "OK" {
 		log.Debug("finished VerifyAPIkey request. Credentials are good to go.")
 		return true
@@ -84,13 +204,17 @@ func GenerateDownloadJSON(configPath string, regen bool, masterKey string) Creds
 			log.Debug("stripping trailing /")
 			urlInput = strings.TrimSuffix(urlInput, "/")
 		}
-		fmt.Printf("Enter your username [%s]: ", creds.Username)
+		fmt.Printf("Enter your username, empty for an access token [%s]: ", creds.Username)
 		userName, _ = reader.ReadString('\n')
 		userName = strings.TrimSuffix(userName, "\n")
 		if userName == "" {
 			userName = creds.Username
 		}
-		fmt.Print("Enter your API key/Password: ")
+		if userName == "" {
+			fmt.Print("Enter your access token: ")
+		} else {
+			fmt.Print("Enter your API key/Password: ")
+		}
 		apiKeyByte, _ := terminal.ReadPassword(0)
 		apiKey = string(apiKeyByte)
 		println()
@@ -111,6 +235,10 @@ func writeFileDownloadJSON(configPath, urlInput, userName, apiKey, dlLocationInp
 		Apikey:     Encrypt(apiKey, masterKey),
 		DlLocation: Encrypt(dlLocationInput, masterKey),
 	}
+	if userName == "" {
+		data.Apikey = Encrypt("", masterKey)
+		data.Token = Encrypt(apiKey, masterKey)
+	}
 	//should probably encrypt data here
 	fileData, err := json.Marshal(data)
 	helpers.Check(err, true, "The JSON marshal", helpers.Trace())
@@ -123,77 +251,255 @@ func writeFileDownloadJSON(configPath, urlInput, userName, apiKey, dlLocationInp
 		Apikey:     apiKey,
 		DlLocation: dlLocationInput,
 	}
+	if userName == "" {
+		data2.Token = apiKey
+	}
 
 	return data2
 }
 
-//GetDownloadJSON get data from DownloadJSON
+//GetDownloadJSON get data from DownloadJSON, prompting for it if there is none
 func GetDownloadJSON(fileLocation string, masterKey string) Creds {
-	var result map[string]interface{}
-	var resultData Creds
-	file, err := os.Open(fileLocation)
+	resultData, err := ReadDownloadJSON(fileLocation, masterKey)
 	if err != nil {
 		log.Error("error:", err)
 		resultData = GenerateDownloadJSON(fileLocation, false, masterKey)
-	} else {
-		//should decrypt here
-		defer file.Close()
-		byteValue, _ := ioutil.ReadAll(file)
-		json.Unmarshal([]byte(byteValue), &result)
-		resultData.URL = Decrypt(result["URL"].(string), masterKey)
-		resultData.Username = Decrypt(result["Username"].(string), masterKey)
-		resultData.Apikey = Decrypt(result["Apikey"].(string), masterKey)
-		resultData.DlLocation = Decrypt(result["DlLocation"].(string), masterKey)
 	}
 	return resultData
 }
 
-//
-func StorageCheck(creds Creds, warning float64, threshold float64) {
-	data, statusCode, _ := GetRestAPI("GET", true, creds.URL+"/api/storageinfo", creds.Username, creds.Apikey, "", nil, 1)
-	if statusCode != 200 {
-		log.Warn("Received bad status code ", statusCode, " trying to get storage info. Proceed with caution")
-		return
+//ReadDownloadJSON get data from DownloadJSON without prompting
+func ReadDownloadJSON(fileLocation string, masterKey string) (Creds, error) {
+	var result map[string]interface{}
+	var resultData Creds
+	file, err := os.Open(fileLocation)
+	if err != nil {
+		return resultData, err
+	}
+	//should decrypt here
+	defer file.Close()
+	byteValue, _ := ioutil.ReadAll(file)
+	json.Unmarshal([]byte(byteValue), &result)
+	resultData.URL = Decrypt(result["URL"].(string), masterKey)
+	resultData.Username = Decrypt(result["Username"].(string), masterKey)
+	resultData.Apikey = Decrypt(result["Apikey"].(string), masterKey)
+	resultData.DlLocation = Decrypt(result["DlLocation"].(string), masterKey)
+	if token, ok := result["Token"].(string); ok && token != "" {
+		resultData.Token = Decrypt(token, masterKey)
+		resultData.Username = ""
+		resultData.Apikey = resultData.Token
+	}
+	if refreshToken, ok := result["RefreshToken"].(string); ok && refreshToken != "" {
+		resultData.RefreshToken = Decrypt(refreshToken, masterKey)
+	}
+	if migrateDownloadJSON(result, masterKey) {
+		fileData, err := json.Marshal(result)
+		helpers.Check(err, true, "The JSON marshal", helpers.Trace())
+		if err := writeFileAtomic(fileLocation, fileData); err != nil {
+			log.Warn("Migrating ", fileLocation, " to scrypt derived keys failed: ", err)
+		} else {
+			log.Info("Migrated ", fileLocation, " to scrypt derived keys")
+		}
+	}
+	return resultData, nil
+}
+
+//SaveDownloadJSONTokens replace the access and refresh tokens in DownloadJSON, e.g. once they were refreshed
+func SaveDownloadJSONTokens(fileLocation string, masterKey string, accessToken string, refreshToken string) error {
+	byteValue, err := ioutil.ReadFile(fileLocation)
+	if err != nil {
+		return err
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(byteValue, &result); err != nil {
+		return err
+	}
+	result["Token"] = Encrypt(accessToken, masterKey)
+	result["RefreshToken"] = Encrypt(refreshToken, masterKey)
+	fileData, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fileLocation, fileData)
+}
+
+//Storage usage reported by storageinfo
+type Storage struct {
+	//UsedPercent of the filestore, -1 when it isn't reported, as with cloud object storage
+	UsedPercent float64
+	//Used human readable filestore usage as reported
+	Used string
+	//RepoBytes space used by each repository
+	RepoBytes map[string]int64
+}
+
+//GetStorage fetch the storage summary. It is calculated asynchronously, so a recalculation is triggered for the next call
+func GetStorage(ctx context.Context, creds Creds) (Storage, error) {
+	data, statusCode, _ := GetRestAPI(ctx, "GET", true, creds.URL+"/api/storageinfo", creds.Username, creds.Apikey, "", nil, 1)
+	if err := CheckStatus("GET", creds.URL+"/api/storageinfo", statusCode); err != nil {
+		return Storage{}, err
 	}
-	//may need to trigger async calculation for newer versions
 	//TODO maybe disable this for large instances.
 	log.Debug("Triggering async POST to update summary page")
-	GetRestAPI("POST", true, creds.URL+"/api/storageinfo/calculate", creds.Username, creds.Apikey, "", nil, 1)
+	GetRestAPI(ctx, "POST", true, creds.URL+"/api/storageinfo/calculate", creds.Username, creds.Apikey, "", nil, 1)
+	return ParseStorage(data)
+}
 
+//ParseStorage a storageinfo response
+func ParseStorage(data []byte) (Storage, error) {
 	var storageData StorageDataJSON
-	err := json.Unmarshal(data, &storageData)
-	helpers.Check(err, false, "check failed", helpers.Trace())
-	log.Debug("free:", storageData.StorageSummary.FileStoreSummary.FreeSpace, " used:", storageData.StorageSummary.FileStoreSummary.UsedSpace)
-	used := strings.Split(storageData.StorageSummary.FileStoreSummary.UsedSpace, "(")
-	log.Debug("useage results:", used)
-	if len(used) > 2 {
-		usedpc := strings.TrimRight(used[1], "%)")
-		i, err := strconv.ParseFloat(usedpc, 32)
-		if err != nil {
-			log.Warn(err)
-			return
+	if err := json.Unmarshal(data, &storageData); err != nil {
+		return Storage{}, err
+	}
+	summary := storageData.storageSummaryJSON
+	if summary.FileStoreSummary.UsedSpace == "" && len(summary.RepositoriesSummaryList) == 0 {
+		summary = storageData.StorageSummary
+	}
+	fileStore := summary.FileStoreSummary
+	log.Debug("free:", fileStore.FreeSpace, " used:", fileStore.UsedSpace)
+
+	storage := Storage{UsedPercent: -1, Used: fileStore.UsedSpace, RepoBytes: make(map[string]int64)}
+	if fileStore.TotalSpaceInBytes > 0 {
+		storage.UsedPercent = float64(fileStore.UsedSpaceInBytes) / float64(fileStore.TotalSpaceInBytes) * 100
+	} else if used := strings.Split(fileStore.UsedSpace, "("); len(used) >= 2 {
+		//"1.35 TB (70.52%)"
+		if percent, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimRight(used[1], "%) ")), 64); err == nil {
+			storage.UsedPercent = percent
 		}
-		if i >= threshold {
-			log.Panic("Summary reporting that disk hit threshold ", warning, "% usage, (", used[1], " killing all downloads")
-			os.Exit(1)
-
-		} else if i >= warning {
-			log.Warn("Summary reporting that disk is over warning ", warning, "% usage, (", used[1], " proceed with caution")
+	}
+	for _, repo := range summary.RepositoriesSummaryList {
+		used := repo.UsedSpaceInBytes
+		if used == 0 && repo.UsedSpace != "" {
+			parsed, err := helpers.ParseSize(repo.UsedSpace)
+			if err != nil {
+				log.Debug("Unparseable usage ", repo.UsedSpace, " of ", repo.RepoKey)
+				continue
+			}
+			used = parsed
 		}
-	} else {
-		log.Warn("storage check returned:", used)
+		storage.RepoBytes[repo.RepoKey] = used
 	}
+	return storage, nil
+}
 
+//RequestObserver told of the outcome of every authenticated request made with a context from WithObserver
+type RequestObserver func(statusCode int, err error)
+
+type observerKey struct{}
+
+//WithObserver a context whose authenticated requests are reported to observe, e.g. to tally the credentials they used
+func WithObserver(ctx context.Context, observe RequestObserver) context.Context {
+	return context.WithValue(ctx, observerKey{}, observe)
+}
+
+//client shared by every request, so limits set with SetTransport apply across crawlers and workers
+var client = &http.Client{}
+
+//SetTransport route every request through rt
+func SetTransport(rt http.RoundTripper) {
+	client.Transport = rt
 }
 
-//GetRestAPI GET rest APIs response with error handling
-func GetRestAPI(method string, auth bool, urlInput, userName, apiKey, providedfilepath string, header map[string]string, retry int) ([]byte, int, http.Header) {
-	if retry > 5 {
-		log.Warn("Exceeded retry limit, cancelling further attempts")
-		return nil, 0, nil
+//Get plain GET, used for crawling upstream indexes, that is cancelled along with ctx.
+//The body is read in full, so the connection is free again before crawlers recurse into the page
+func Get(ctx context.Context, urlInput string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", urlInput, nil)
+	if err != nil {
+		return nil, err
 	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		metrics.ObserveRequest("GET", 0, time.Since(start))
+		return nil, err
+	}
+	metrics.ObserveRequest("GET", resp.StatusCode, time.Since(start))
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	stats.Transferred(int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return resp, nil
+}
+
+//Discard download path that streams the body away instead of writing it to disk, for only warming the cache
+const Discard = "-"
+
+//RemoveDownload delete a file GetRestAPI downloaded, there is nothing to delete for Discard
+func RemoveDownload(path string) error {
+	if path == Discard {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+//RetryPolicy how GetRestAPI retries requests that got no response or a retryable status code
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Statuses    map[int]bool
+}
+
+var retryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   time.Second,
+	MaxDelay:    time.Minute,
+	Statuses:    map[int]bool{204: true, 429: true, 500: true, 502: true, 503: true, 504: true},
+}
+
+//SetRetryPolicy replace the default retry policy
+func SetRetryPolicy(policy RetryPolicy) {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	retryPolicy = policy
+}
+
+func (p RetryPolicy) retryable(method string, statusCode int) bool {
+	//204 is a fine answer to anything but a GET, e.g. no content for a docker manifest
+	if statusCode == 204 && method != "GET" {
+		return false
+	}
+	return p.Statuses[statusCode]
+}
+
+//backoff delay before the given retry, doubling every time up to MaxDelay, half of it random so workers don't retry in lockstep
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.MaxDelay
+	if retry < 32 && p.BaseDelay<<uint(retry-1) < p.MaxDelay {
+		delay = p.BaseDelay << uint(retry-1)
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(mathrand.Int63n(int64(delay/2)))
+}
+
+//GetRestAPI GET rest APIs response with error handling. Requests that get no response, or a status
+//code the retry policy lists, are retried with backoff and the last attempt's result is returned.
+//retry is the attempt to start counting from, 0 and 1 both being the first
+func GetRestAPI(ctx context.Context, method string, auth bool, urlInput, userName, apiKey, providedfilepath string, header map[string]string, retry int) ([]byte, int, http.Header) {
+	data, statusCode, headers, _ := restAPI(ctx, method, auth, urlInput, userName, apiKey, providedfilepath, header, retry, Checksum{})
+	return data, statusCode, headers
+}
 
-	body := new(bytes.Buffer)
+//Download GET urlInput into path, or Discard, verifying the body against expected or, without one, the checksum
+//Artifactory sent in its X-Checksum headers. err is a *StatusError for a bad status and a *ChecksumError for a mismatch
+func Download(ctx context.Context, auth bool, urlInput, userName, apiKey, path string, expected Checksum) (int, http.Header, error) {
+	_, statusCode, headers, err := restAPI(ctx, "GET", auth, urlInput, userName, apiKey, path, nil, 1, expected)
+	var mismatch *ChecksumError
+	if errors.As(err, &mismatch) {
+		return statusCode, headers, err
+	}
+	return statusCode, headers, CheckStatus("GET", urlInput, statusCode)
+}
+
+//restAPI GetRestAPI with the error of the last attempt
+func restAPI(ctx context.Context, method string, auth bool, urlInput, userName, apiKey, providedfilepath string, header map[string]string, retry int, expected Checksum) ([]byte, int, http.Header, error) {
+	var body []byte
 	//PUT upload file
 	if method == "PUT" && providedfilepath != "" {
 		//req.Header.Set()
@@ -201,144 +507,248 @@ func GetRestAPI(method string, auth bool, urlInput, userName, apiKey, providedfi
 		helpers.Check(err, false, "open", helpers.Trace())
 		defer file.Close()
 
-		writer := multipart.NewWriter(body)
+		buf := new(bytes.Buffer)
+		writer := multipart.NewWriter(buf)
 
 		part, err := writer.CreateFormFile("file", filepath.Base(providedfilepath))
 		helpers.Check(err, false, "create", helpers.Trace())
 		io.Copy(part, file)
 		err = writer.Close()
 		helpers.Check(err, false, "writer close", helpers.Trace())
+		body = buf.Bytes()
+	}
+
+	policy := retryPolicy
+	attempt := retry
+	if attempt < 1 {
+		attempt = 1
+	}
+	refreshed := false
+	for {
+		sent := apiKey
+		if auth && userName == "" && apiKey != "" {
+			//pinned for this attempt, so a 401 can tell whether another request already refreshed the token
+			sent = bearerToken(ctx, apiKey)
+		}
+		data, statusCode, headers, err := restAPIAttempt(ctx, method, auth, urlInput, userName, sent, providedfilepath, header, body, expected)
+		if ctx.Err() != nil {
+			return nil, 0, nil, ctx.Err()
+		}
+		if err == nil && statusCode == http.StatusUnauthorized && auth && userName == "" && apiKey != "" && !refreshed {
+			//a refreshed token gets one more go, outside the retry policy
+			refreshed = true
+			if tokenRejected(ctx, urlInput, apiKey, sent, headers) {
+				continue
+			}
+		}
+		var mismatch *ChecksumError
+		if errors.As(err, &mismatch) {
+			//a corrupt cache serves the same corrupt artifact again, so report it rather than retry
+			log.Error(err)
+			return nil, statusCode, headers, err
+		}
+		if err == nil && !policy.retryable(method, statusCode) {
+			return data, statusCode, headers, nil
+		}
+		reason := "received " + strconv.Itoa(statusCode)
+		if err != nil {
+			reason = "failed with " + err.Error()
+		}
+		if attempt >= policy.MaxAttempts {
+			logging.FromContext(ctx).WithFields(log.Fields{logging.Method: method, logging.URL: urlInput, logging.Status: statusCode}).Warn(method, " request for ", urlInput, " ", reason, ", giving up after ", attempt, " attempts")
+			if err != nil {
+				return nil, 0, headers, err
+			}
+			return data, statusCode, headers, nil
+		}
+		pause := policy.backoff(attempt)
+		if until, ok := ratelimit.RetryAfter(headers); ok && time.Until(until) > pause {
+			pause = time.Until(until)
+		}
+		logging.FromContext(ctx).WithFields(log.Fields{logging.Method: method, logging.URL: urlInput, logging.Status: statusCode}).Warn(method, " request for ", urlInput, " ", reason, ", retrying in ", pause.Round(time.Millisecond), ", attempt ", attempt+1, " of ", policy.MaxAttempts)
+		stats.Retried()
+		if !helpers.SleepContext(ctx, pause) {
+			return nil, 0, nil, ctx.Err()
+		}
+		attempt++
 	}
+}
 
-	client := http.Client{}
-	req, err := http.NewRequest(method, urlInput, body)
+//restAPIAttempt make a GetRestAPI request once. err is set when no complete response was received, or a download didn't match its checksum
+func restAPIAttempt(ctx context.Context, method string, auth bool, urlInput, userName, apiKey, providedfilepath string, header map[string]string, body []byte, expected Checksum) ([]byte, int, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, method, urlInput, bytes.NewReader(body))
+	if err != nil {
+		log.Warn("The HTTP request failed with error", err)
+		return nil, 0, nil, nil
+	}
 	if auth {
-		req.SetBasicAuth(userName, apiKey)
+		setAuth(ctx, req, userName, apiKey)
 	}
 	for x, y := range header {
 		log.Debug("Recieved extra header:", x+":"+y)
 		req.Header.Set(x, y)
 	}
 
-	if err != nil {
-		log.Warn("The HTTP request failed with error", err)
-	} else {
-
-		resp, err := client.Do(req)
-		helpers.Check(err, false, "The HTTP response", helpers.Trace())
+	start := time.Now()
+	resp, err := client.Do(req)
+	took := time.Since(start)
+	reqLog := logging.FromContext(ctx).WithFields(log.Fields{logging.Method: method, logging.URL: urlInput, logging.Duration: logging.Seconds(took)})
 
-		if err != nil {
-			return nil, 0, nil
+	observe, _ := ctx.Value(observerKey{}).(RequestObserver)
+	if err != nil {
+		reqLog.Warn("The HTTP response failed with error:", err)
+		metrics.ObserveRequest(method, 0, took)
+		if auth && observe != nil {
+			observe(0, err)
 		}
-		// need to account for 403s with xray, or other 403s, 429? 204 is bad too (no content for docker)
-		switch resp.StatusCode {
-		case 200:
-			log.Debug("Received ", resp.StatusCode, " OK on ", method, " request for ", urlInput, " continuing")
-		case 201:
-			if method == "PUT" {
-				log.Debug("Received ", resp.StatusCode, " ", method, " request for ", urlInput, " continuing")
-			}
-		case 403:
-			log.Error("Received ", resp.StatusCode, " Forbidden on ", method, " request for ", urlInput, " continuing")
-			// should we try retry here? probably not
-		case 404:
-			log.Debug("Received ", resp.StatusCode, " Not Found on ", method, " request for ", urlInput, " continuing")
-		case 429:
-			log.Error("Received ", resp.StatusCode, " Too Many Requests on ", method, " request for ", urlInput, ", sleeping then retrying, attempt ", retry)
-			time.Sleep(10 * time.Second)
-			GetRestAPI(method, auth, urlInput, userName, apiKey, providedfilepath, header, retry+1)
-		case 204:
-			if method == "GET" {
-				log.Error("Received ", resp.StatusCode, " No Content on ", method, " request for ", urlInput, ", sleeping then retrying")
-				time.Sleep(10 * time.Second)
-				GetRestAPI(method, auth, urlInput, userName, apiKey, providedfilepath, header, retry+1)
-			} else {
-				log.Debug("Received ", resp.StatusCode, " OK on ", method, " request for ", urlInput, " continuing")
-			}
-		case 500:
-			log.Error("Received ", resp.StatusCode, " Internal Server error on ", method, " request for ", urlInput, " failing out")
-			return nil, 0, nil
-		default:
-			log.Warn("Received ", resp.StatusCode, " on ", method, " request for ", urlInput, " continuing")
+		return nil, 0, nil, err
+	}
+	metrics.ObserveRequest(method, resp.StatusCode, took)
+	if auth && observe != nil {
+		observe(resp.StatusCode, nil)
+	}
+	defer resp.Body.Close()
+	reqLog = reqLog.WithField(logging.Status, resp.StatusCode)
+	// need to account for 403s with xray, or other 403s
+	switch resp.StatusCode {
+	case 200:
+		reqLog.Debug("Received ", resp.StatusCode, " OK on ", method, " request for ", urlInput, " continuing")
+	case 201:
+		if method == "PUT" {
+			reqLog.Debug("Received ", resp.StatusCode, " ", method, " request for ", urlInput, " continuing")
 		}
-		//Mostly for HEAD requests
-		statusCode := resp.StatusCode
-		headers := resp.Header
+	case 204:
+		reqLog.Debug("Received ", resp.StatusCode, " No Content on ", method, " request for ", urlInput)
+	case 403:
+		reqLog.Error("Received ", resp.StatusCode, " Forbidden on ", method, " request for ", urlInput, " continuing")
+		// should we try retry here? probably not
+	case 404:
+		reqLog.Debug("Received ", resp.StatusCode, " Not Found on ", method, " request for ", urlInput, " continuing")
+	default:
+		reqLog.Warn("Received ", resp.StatusCode, " on ", method, " request for ", urlInput)
+	}
+	//Mostly for HEAD requests
+	statusCode := resp.StatusCode
+	headers := resp.Header
 
-		if providedfilepath != "" && method == "GET" {
+	if providedfilepath != "" && method == "GET" {
+		var out io.Writer = ioutil.Discard
+		if providedfilepath != Discard {
 			// Create the file
-			out, err := os.Create(providedfilepath)
+			file, err := os.Create(providedfilepath)
 			helpers.Check(err, false, "File create:"+providedfilepath, helpers.Trace())
-			defer out.Close()
-
-			//done := make(chan int64)
-			//go helpers.PrintDownloadPercent(done, filepath, int64(resp.ContentLength))
-			_, err = io.Copy(out, resp.Body)
-			helpers.Check(err, false, "The file copy:"+providedfilepath, helpers.Trace())
-		} else {
-			//maybe skip the download or retry if error here, like EOF
-			data, err := ioutil.ReadAll(resp.Body)
-			helpers.Check(err, false, "Data read:"+urlInput, helpers.Trace())
 			if err != nil {
-				log.Warn("Data Read on ", urlInput, " failed with:", err, ", sleeping then retrying, attempt:", retry)
-				time.Sleep(10 * time.Second)
-
-				GetRestAPI(method, auth, urlInput, userName, apiKey, providedfilepath, header, retry+1)
+				return nil, statusCode, headers, err
 			}
+			defer file.Close()
+			out = file
+		}
 
-			return data, statusCode, headers
+		//hash while downloading, preferring the checksum the caller got from upstream over Artifactory's
+		if expected.Value == "" {
+			expected = HeaderChecksum(resp.Header)
+		}
+		hasher := expected.newHash()
+		if hasher != nil && statusCode == 200 {
+			out = io.MultiWriter(out, hasher)
+		}
+
+		//done := make(chan int64)
+		//go helpers.PrintDownloadPercent(done, filepath, int64(resp.ContentLength))
+		written, err := io.Copy(out, resp.Body)
+		stats.Transferred(written)
+		helpers.Check(err, false, "The file copy:"+providedfilepath, helpers.Trace())
+		if err != nil {
+			//don't leave partial files behind, e.g. when the run is cancelled mid download
+			RemoveDownload(providedfilepath)
+			return nil, statusCode, headers, err
+		}
+		if hasher != nil && statusCode == 200 {
+			if actual := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(actual, expected.Value) {
+				RemoveDownload(providedfilepath)
+				return nil, statusCode, headers, &ChecksumError{URL: urlInput, Expected: expected, Actual: actual}
+			}
 		}
+		if statusCode == 200 {
+			stats.Downloaded()
+		}
+		return nil, statusCode, headers, nil
 	}
-	return nil, 0, nil
+	data, err := ioutil.ReadAll(resp.Body)
+	stats.Transferred(int64(len(data)))
+	helpers.Check(err, false, "Data read:"+urlInput, helpers.Trace())
+	return data, statusCode, headers, err
 }
 
-//CreateHash self explanatory
+//CreateHash self explanatory. Only decrypts values written before keys were derived with scrypt, see deriveKey
 func CreateHash(key string) string {
 	hasher := md5.New()
 	hasher.Write([]byte(key))
 	return hex.EncodeToString(hasher.Sum(nil))
 }
 
-//Encrypt self explanatory
+//Encrypt self explanatory. The key is derived from passphrase with scrypt and a salt stored with the ciphertext
 func Encrypt(dataString string, passphrase string) string {
 	data := []byte(dataString)
-	block, _ := aes.NewCipher([]byte(CreateHash(passphrase)))
+	salt, key := encryptionKey(passphrase)
+	block, _ := aes.NewCipher(key)
 	gcm, err := cipher.NewGCM(block)
 	helpers.Check(err, true, "Cipher", helpers.Trace())
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
 		panic(err.Error())
 	}
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-	return base64.RawURLEncoding.EncodeToString([]byte(ciphertext))
+	ciphertext := gcm.Seal(append(salt, nonce...), nonce, data, nil)
+	return scryptPrefix + base64.RawURLEncoding.EncodeToString([]byte(ciphertext))
 }
 
-//Decrypt self explanatory
+//Decrypt self explanatory. Values from before scrypt, without its prefix, are still decrypted with the old MD5 based key
 func Decrypt(dataString string, passphrase string) string {
-	data, _ := base64.RawURLEncoding.DecodeString(dataString)
+	plaintext, err := decrypt(dataString, passphrase)
+	helpers.Check(err, true, "GCM open", helpers.Trace())
+	return string(plaintext)
+}
 
-	key := []byte(CreateHash(passphrase))
+func decrypt(dataString string, passphrase string) ([]byte, error) {
+	var key []byte
+	if Legacy(dataString) {
+		key = []byte(CreateHash(passphrase))
+	} else {
+		dataString = strings.TrimPrefix(dataString, scryptPrefix)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(dataString)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		if len(data) < saltSize {
+			return nil, errors.New("ciphertext too short")
+		}
+		key = deriveKey(passphrase, data[:saltSize])
+		data = data[saltSize:]
+	}
 	block, err := aes.NewCipher(key)
-	helpers.Check(err, true, "Cipher", helpers.Trace())
+	if err != nil {
+		return nil, err
+	}
 	gcm, err := cipher.NewGCM(block)
-	helpers.Check(err, true, "Cipher GCM", helpers.Trace())
-	// TODO if decrypt failure
-	//	if err != nil {
-	// 	GenerateDownloadJSON(fileLocation, false, passphrase)
-	// }
+	if err != nil {
+		return nil, err
+	}
 	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	helpers.Check(err, true, "GCM open", helpers.Trace())
-	return string(plaintext)
+	return gcm.Open(nil, nonce, ciphertext, nil)
 }
 
-//VerifyMasterKey self explanatory
+//VerifyMasterKey self explanatory. A master key protected with ProtectMasterKey is unlocked with PKGDL_PASSPHRASE, or a prompt for it
 func VerifyMasterKey(configPath string) string {
 	_, err := os.Open(configPath)
 	var token string
 	if err != nil {
-		log.Warn("Finding master key failed with error %s\n", err)
+		log.Warn("Finding master key failed with error ", err)
 		data, err := generateRandomBytes(32)
 		helpers.Check(err, true, "Generating new master key", helpers.Trace())
 		err2 := ioutil.WriteFile(configPath, []byte(base64.URLEncoding.EncodeToString(data)), 0600)
@@ -349,6 +759,10 @@ func VerifyMasterKey(configPath string) string {
 		dat, err := ioutil.ReadFile(configPath)
 		helpers.Check(err, true, "Reading master key", helpers.Trace())
 		token = string(dat)
+		if protected(token) {
+			token, err = unlockMasterKey(token)
+			helpers.Check(err, true, "Unlocking master key", helpers.Trace())
+		}
 	}
 	return token
 }
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetRestAPIRetries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	defer SetRetryPolicy(retryPolicy)
+	SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond, Statuses: map[int]bool{503: true}})
+	data, statusCode, _ := GetRestAPI(context.Background(), "GET", false, server.URL, "", "", "", nil, 1)
+	if statusCode != 200 || string(data) != "OK" {
+		t.Errorf("expected the successful attempt's result, got %d %q", statusCode, data)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls)
+	}
+}
+
+func TestGetRestAPIGivesUp(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	defer SetRetryPolicy(retryPolicy)
+	SetRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Statuses: map[int]bool{502: true}})
+	_, statusCode, _ := GetRestAPI(context.Background(), "GET", false, server.URL, "", "", "", nil, 1)
+	if statusCode != 502 || calls != 2 {
+		t.Errorf("expected 502 after 2 attempts, got %d after %d", statusCode, calls)
+	}
+
+	//connection refused is retried as well, and reported as no response
+	server.Close()
+	start := time.Now()
+	if _, statusCode, _ := GetRestAPI(context.Background(), "GET", false, server.URL, "", "", "", nil, 1); statusCode != 0 {
+		t.Errorf("expected status 0 without a server, got %d", statusCode)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("expected retries to back off for milliseconds")
+	}
+}
+
+func TestGetRestAPIDiscard(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tarball"))
+	}))
+	defer server.Close()
+
+	data, statusCode, _ := GetRestAPI(context.Background(), "GET", false, server.URL, "", "", Discard, nil, 1)
+	if statusCode != 200 || data != nil {
+		t.Errorf("expected 200 and the body discarded, got %d %q", statusCode, data)
+	}
+	if _, err := os.Stat(Discard); !os.IsNotExist(err) {
+		t.Error("expected no file to be written")
+	}
+	if err := RemoveDownload(Discard); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//deliberately wrong sha1 of "tarball": a sha256 from the caller must be preferred over it, and without one the download must fail
+		w.Header().Set("X-Checksum-Sha1", "d4f8b1d5b4f5c1bd4c7ac8dc0d0f5d8e2d4a1d5b")
+		w.Write([]byte("tarball"))
+	}))
+	defer server.Close()
+
+	sum := sha256.Sum256([]byte("tarball"))
+	if _, _, err := Download(context.Background(), false, server.URL, "", "", Discard, Checksum{Algorithm: "sha256", Value: hex.EncodeToString(sum[:])}); err != nil {
+		t.Errorf("expected the upstream checksum to be preferred and match, got %v", err)
+	}
+
+	_, _, err := Download(context.Background(), false, server.URL, "", "", Discard, Checksum{})
+	var mismatch *ChecksumError
+	if !errors.As(err, &mismatch) || mismatch.Expected.Algorithm != "sha1" {
+		t.Errorf("expected a sha1 mismatch against Artifactory's header, got %v", err)
+	}
+}
+
+func TestBearerTokenRefresh(t *testing.T) {
+	var refreshes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/security/token" {
+			atomic.AddInt32(&refreshes, 1)
+			if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh" || r.FormValue("access_token") != "expired" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"access_token":"renewed","refresh_token":"refresh2","expires_in":3600}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer renewed" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	var saved string
+	SetRefreshToken(server.URL, "expired", "refresh", func(access string, refresh string) { saved = access + " " + refresh })
+	data, statusCode, _ := GetRestAPI(context.Background(), "GET", true, server.URL+"/api/system/ping", "", "expired", "", nil, 1)
+	if statusCode != 200 || string(data) != "OK" {
+		t.Errorf("expected the request to succeed with the refreshed token, got %d %q", statusCode, data)
+	}
+	if refreshes != 1 || saved != "renewed refresh2" {
+		t.Errorf("expected one refresh whose tokens are saved, got %d refreshes and %q", refreshes, saved)
+	}
+
+	//later requests use the refreshed token straight away
+	if _, statusCode, _ := GetRestAPI(context.Background(), "GET", true, server.URL+"/api/system/ping", "", "expired", "", nil, 1); statusCode != 200 || refreshes != 1 {
+		t.Errorf("expected 200 without another refresh, got %d after %d refreshes", statusCode, refreshes)
+	}
+
+	//workers rejected at the same time refresh once, every refresh revokes the token before it
+	var concurrentRefreshes int32
+	var valid atomic.Value
+	valid.Store("")
+	concurrent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/security/token" {
+			n := atomic.AddInt32(&concurrentRefreshes, 1)
+			access := fmt.Sprintf("renewed%d", n)
+			valid.Store(access)
+			fmt.Fprintf(w, `{"access_token":%q,"refresh_token":"refresh","expires_in":3600}`, access)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+valid.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer concurrent.Close()
+
+	SetRefreshToken(concurrent.URL, "stale", "refresh", nil)
+	var wg sync.WaitGroup
+	var failed int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, statusCode, _ := GetRestAPI(context.Background(), "GET", true, concurrent.URL+"/api/system/ping", "", "stale", "", nil, 1); statusCode != 200 {
+				atomic.AddInt32(&failed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if failed != 0 || concurrentRefreshes != 1 {
+		t.Errorf("expected every request to succeed after one refresh, got %d failed and %d refreshes", failed, concurrentRefreshes)
+	}
+
+	//a failing token endpoint is left alone for a while instead of being called on every request
+	var failedRefreshes int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/security/token" {
+			atomic.AddInt32(&failedRefreshes, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer broken.Close()
+
+	SetRefreshToken(broken.URL, "revoked", "refresh", nil)
+	for i := 0; i < 5; i++ {
+		if _, statusCode, _ := GetRestAPI(context.Background(), "GET", true, broken.URL+"/api/system/ping", "", "revoked", "", nil, 1); statusCode != 401 {
+			t.Errorf("expected 401 while the token can't be refreshed, got %d", statusCode)
+		}
+	}
+	if failedRefreshes != 1 {
+		t.Errorf("expected one refresh attempt within the backoff, got %d", failedRefreshes)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"jfrt@01/users/admin","exp":1600000000}`))
+	if expires, ok := TokenExpiry("eyJhbGciOiJSUzI1NiJ9." + payload + ".signature"); !ok || expires.Unix() != 1600000000 {
+		t.Errorf("expected the exp claim to be read, got %v (ok %v)", expires, ok)
+	}
+	if _, ok := TokenExpiry("cmVmdGtuOjAxOjE2MDAwMDAwMDA6reference"); ok {
+		t.Error("expected a reference token to have no known expiry")
+	}
+}
+
+func TestParseStorage(t *testing.T) {
+	//current versions: summary at the top level, with byte counts
+	storage, err := ParseStorage([]byte(`{"fileStoreSummary":{"usedSpace":"700 GB (70%)","usedSpaceInBytes":700,"totalSpaceInBytes":1000},
+		"repositoriesSummaryList":[{"repoKey":"npm-remote-cache","usedSpace":"1.5 GB","usedSpaceInBytes":1610612736},{"repoKey":"TOTAL","usedSpace":"700 GB"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.UsedPercent != 70 {
+		t.Errorf("used %v%%, want 70%%", storage.UsedPercent)
+	}
+	if storage.RepoBytes["npm-remote-cache"] != 1610612736 || storage.RepoBytes["TOTAL"] != 700<<30 {
+		t.Errorf("repo bytes %v", storage.RepoBytes)
+	}
+
+	//older versions: wrapped in storageSummary, sizes only as strings
+	storage, err = ParseStorage([]byte(`{"storageSummary":{"fileStoreSummary":{"usedSpace":"1.35 TB (70.52%)"},
+		"repositoriesSummaryList":[{"repoKey":"npm-remote-cache","usedSpace":"20 MB"}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.UsedPercent != 70.52 || storage.RepoBytes["npm-remote-cache"] != 20<<20 {
+		t.Errorf("got %+v", storage)
+	}
+
+	storage, err = ParseStorage([]byte(`{"fileStoreSummary":{"usedSpace":"unknown"}}`))
+	if err != nil || storage.UsedPercent != -1 {
+		t.Errorf("unknown usage parsed as %v, %v", storage.UsedPercent, err)
+	}
+}
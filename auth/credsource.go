@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//helperTimeout how long a credential helper command gets to print its credentials
+const helperTimeout = 30 * time.Second
+
+//CredSources where ResolveCreds looks for credentials, besides the environment and ~/.netrc
+type CredSources struct {
+	//URL of Artifactory, its host picks the ~/.netrc entry
+	URL string
+	//HasProfile the selected profile exists, ~/.netrc is then skipped so an entry meant for another tool can't replace it
+	HasProfile bool
+	//Username the API key in APIKeyFile belongs to. Without one, the file holds an access token
+	Username   string
+	APIKeyFile string
+	//Helper shell command printing {"url", "username", "apikey", "token"} JSON, run with PKGDL_URL set
+	Helper string
+}
+
+//ResolveCreds credentials found without prompting, trying in order PKGDL_USER/PKGDL_APIKEY/PKGDL_TOKEN (with PKGDL_URL),
+//the ~/.netrc entry for the URL's host unless there is a profile, the API key file and the credential helper. Returns the source they came from,
+//empty if none of them had credentials
+func ResolveCreds(ctx context.Context, sources CredSources) (Creds, string, error) {
+	creds := Creds{URL: os.Getenv("PKGDL_URL")}
+	if creds.URL == "" {
+		creds.URL = sources.URL
+	}
+	creds.URL = strings.TrimSuffix(creds.URL, "/")
+
+	if token := os.Getenv("PKGDL_TOKEN"); token != "" {
+		creds.Apikey = token
+		return creds, "environment", nil
+	}
+	if apiKey := os.Getenv("PKGDL_APIKEY"); apiKey != "" {
+		creds.Username = os.Getenv("PKGDL_USER")
+		creds.Apikey = apiKey
+		return creds, "environment", nil
+	}
+
+	if creds.URL != "" && !sources.HasProfile {
+		login, password, found, err := netrcLogin(creds.URL)
+		if err != nil {
+			return creds, "", fmt.Errorf("reading netrc: %v", err)
+		}
+		if found {
+			creds.Username = login
+			creds.Apikey = password
+			return creds, "netrc", nil
+		}
+	}
+
+	if sources.APIKeyFile != "" {
+		data, err := ioutil.ReadFile(sources.APIKeyFile)
+		if err != nil {
+			return creds, "", err
+		}
+		creds.Username = sources.Username
+		creds.Apikey = strings.TrimSpace(string(data))
+		if creds.Apikey == "" {
+			return creds, "", fmt.Errorf("%s is empty", sources.APIKeyFile)
+		}
+		return creds, sources.APIKeyFile, nil
+	}
+
+	if sources.Helper != "" {
+		helped, err := runHelper(ctx, sources.Helper, creds.URL)
+		if err != nil {
+			return creds, "", fmt.Errorf("credential helper: %v", err)
+		}
+		if helped.URL == "" {
+			helped.URL = creds.URL
+		}
+		return helped, "credential helper", nil
+	}
+	return creds, "", nil
+}
+
+//helperOutput JSON a credential helper prints
+type helperOutput struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Apikey   string `json:"apikey"`
+	Token    string `json:"token"`
+}
+
+func runHelper(ctx context.Context, command string, urlInput string) (Creds, error) {
+	ctx, cancel := context.WithTimeout(ctx, helperTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), "PKGDL_URL="+urlInput)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return Creds{}, fmt.Errorf("%v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var output helperOutput
+	if err := json.Unmarshal(out, &output); err != nil {
+		return Creds{}, fmt.Errorf("invalid JSON: %v", err)
+	}
+	creds := Creds{URL: strings.TrimSuffix(output.URL, "/"), Username: output.Username, Apikey: output.Apikey}
+	if output.Token != "" {
+		creds.Username = ""
+		creds.Apikey = output.Token
+	}
+	if creds.Apikey == "" {
+		return Creds{}, fmt.Errorf("no apikey or token in its output")
+	}
+	return creds, nil
+}
+
+//netrcPath $NETRC, or ~/.netrc
+func netrcPath() (string, error) {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path, nil
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, ".netrc"), nil
+}
+
+//netrcLogin the login and password of the netrc machine matching urlInput's host
+func netrcLogin(urlInput string) (string, string, bool, error) {
+	parsed, err := url.Parse(urlInput)
+	if err != nil {
+		return "", "", false, err
+	}
+	path, err := netrcPath()
+	if err != nil {
+		return "", "", false, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", "", false, nil
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+	defer file.Close()
+	login, password, found := parseNetrc(bufio.NewScanner(file), parsed.Hostname())
+	return login, password, found, nil
+}
+
+//parseNetrc find host's machine entry in netrc tokens. The default entry is ignored, it is meant for whatever host
+//a tool is pointed at, not for Artifactory in particular
+func parseNetrc(scanner *bufio.Scanner, host string) (string, string, bool) {
+	scanner.Split(bufio.ScanWords)
+	type entry struct{ login, password string }
+	var machines = make(map[string]*entry)
+	var current *entry
+scan:
+	for scanner.Scan() {
+		switch scanner.Text() {
+		case "machine":
+			current = nil
+			if scanner.Scan() {
+				current = &entry{}
+				if _, ok := machines[scanner.Text()]; !ok {
+					machines[scanner.Text()] = current
+				}
+			}
+		case "default":
+			current = nil
+		case "login":
+			if scanner.Scan() && current != nil {
+				current.login = scanner.Text()
+			}
+		case "password":
+			if scanner.Scan() && current != nil {
+				current.password = scanner.Text()
+			}
+		case "macdef":
+			//macros run until a blank line, which ScanWords can't see, so stop looking
+			break scan
+		}
+	}
+	if found, ok := machines[host]; ok && found.password != "" {
+		return found.login, found.password, true
+	}
+	return "", "", false
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+	netrc := `machine github.com login octocat password ghp_x
+machine artifactory.example.com
+	login ci
+	password s3cret
+default login anonymous password guest
+macdef init
+	machine evil.example.com login nope password nope
+`
+	login, password, ok := parseNetrc(bufio.NewScanner(strings.NewReader(netrc)), "artifactory.example.com")
+	if !ok || login != "ci" || password != "s3cret" {
+		t.Errorf("expected ci/s3cret, got %s/%s (ok %v)", login, password, ok)
+	}
+	login, _, ok = parseNetrc(bufio.NewScanner(strings.NewReader(netrc)), "evil.example.com")
+	if ok {
+		t.Errorf("expected the default entry to be ignored, got %s", login)
+	}
+}
+
+func TestResolveCredsHelper(t *testing.T) {
+	for _, name := range []string{"PKGDL_URL", "PKGDL_USER", "PKGDL_APIKEY", "PKGDL_TOKEN"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+	os.Setenv("NETRC", os.DevNull)
+	defer os.Unsetenv("NETRC")
+
+	creds, source, err := ResolveCreds(context.Background(), CredSources{
+		URL:    "https://artifactory.example.com/artifactory/",
+		Helper: `echo "{\"username\": \"ci\", \"apikey\": \"key-for-$PKGDL_URL\"}"`,
+	})
+	if err != nil || source != "credential helper" {
+		t.Fatalf("expected the helper to be used, got %q (%v)", source, err)
+	}
+	if creds.Username != "ci" || creds.Apikey != "key-for-https://artifactory.example.com/artifactory" || creds.URL != "https://artifactory.example.com/artifactory" {
+		t.Errorf("unexpected credentials %+v", creds)
+	}
+
+	//the environment comes first
+	os.Setenv("PKGDL_TOKEN", "token")
+	if creds, source, _ := ResolveCreds(context.Background(), CredSources{Helper: "exit 1"}); source != "environment" || creds.Username != "" || creds.Apikey != "token" {
+		t.Errorf("expected the token from the environment, got %+v from %q", creds, source)
+	}
+}
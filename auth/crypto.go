@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	//scryptPrefix marks values encrypted with a key derived by scrypt. '$' is not in the base64 alphabet, so older values never have it
+	scryptPrefix = "scrypt$"
+	//protectedPrefix marks a master.key encrypted with a passphrase
+	protectedPrefix = "passphrase$"
+	//credsFileHeader first line of a credsfile encrypted with EncryptCredsFile
+	credsFileHeader = "#pkgdl-encrypted"
+
+	saltSize = 16
+	//scrypt cost parameters, as recommended for interactive logins
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+//keys derived keys by passphrase and salt, and the salt Encrypt uses for each passphrase, so a file full of values costs one derivation
+var keys = struct {
+	sync.Mutex
+	derived map[string][]byte
+	salts   map[string][]byte
+}{derived: make(map[string][]byte), salts: make(map[string][]byte)}
+
+//deriveKey the AES-256 key for passphrase and salt
+func deriveKey(passphrase string, salt []byte) []byte {
+	cacheKey := passphrase + "\x00" + string(salt)
+	keys.Lock()
+	defer keys.Unlock()
+	if key, ok := keys.derived[cacheKey]; ok {
+		return key
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		//only returned for invalid cost parameters, which are constants
+		panic(err)
+	}
+	keys.derived[cacheKey] = key
+	return key
+}
+
+//encryptionKey a random salt, picked once per passphrase and run, and the key it derives
+func encryptionKey(passphrase string) ([]byte, []byte) {
+	keys.Lock()
+	salt, ok := keys.salts[passphrase]
+	if !ok {
+		var err error
+		salt, err = generateRandomBytes(saltSize)
+		if err != nil {
+			keys.Unlock()
+			panic(err)
+		}
+		keys.salts[passphrase] = salt
+	}
+	keys.Unlock()
+	return append([]byte(nil), salt...), deriveKey(passphrase, salt)
+}
+
+//Legacy whether value was encrypted before keys were derived with scrypt
+func Legacy(value string) bool {
+	return !strings.HasPrefix(value, scryptPrefix)
+}
+
+func protected(masterKey string) bool {
+	return strings.HasPrefix(masterKey, protectedPrefix)
+}
+
+//ReadPassphrase PKGDL_PASSPHRASE, or prompt for it if there is a terminal
+func ReadPassphrase(prompt string) (string, error) {
+	if passphrase, ok := os.LookupEnv("PKGDL_PASSPHRASE"); ok {
+		return passphrase, nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return "", errors.New("no terminal to prompt for the passphrase, set PKGDL_PASSPHRASE")
+	}
+	fmt.Print(prompt)
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return string(passphrase), err
+}
+
+func unlockMasterKey(stored string) (string, error) {
+	passphrase, err := ReadPassphrase("Enter the master key passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	masterKey, err := decrypt(strings.TrimPrefix(stored, protectedPrefix), passphrase)
+	if err != nil {
+		return "", errors.New("wrong passphrase")
+	}
+	return string(masterKey), nil
+}
+
+//ProtectMasterKey rewrite the master key at configPath encrypted with passphrase, or unprotected if passphrase is empty
+func ProtectMasterKey(configPath string, masterKey string, passphrase string) error {
+	stored := masterKey
+	if passphrase != "" {
+		stored = protectedPrefix + Encrypt(masterKey, passphrase)
+	}
+	return writeFileAtomic(configPath, []byte(stored))
+}
+
+//migrateDownloadJSON re-encrypt the values of a DownloadJSON written before scrypt, so it needs no MD5 derived key again
+func migrateDownloadJSON(result map[string]interface{}, masterKey string) bool {
+	migrated := false
+	for field, value := range result {
+		if encrypted, ok := value.(string); ok && encrypted != "" && Legacy(encrypted) {
+			result[field] = Encrypt(Decrypt(encrypted, masterKey), masterKey)
+			migrated = true
+		}
+	}
+	return migrated
+}
+
+//EncryptCredsFile encrypt a plaintext credsfile in place with the master key
+func EncryptCredsFile(path string, masterKey string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(data, []byte(credsFileHeader)) {
+		return fmt.Errorf("%s is already encrypted", path)
+	}
+	return writeFileAtomic(path, []byte(credsFileHeader+"\n"+Encrypt(string(data), masterKey)+"\n"))
+}
+
+//ReadCredsFile the contents of a credsfile, decrypted if it was encrypted with EncryptCredsFile
+func ReadCredsFile(path string, masterKey string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || !bytes.HasPrefix(data, []byte(credsFileHeader)) {
+		return data, err
+	}
+	encrypted := strings.TrimSpace(strings.TrimPrefix(string(data), credsFileHeader))
+	plaintext, err := decrypt(encrypted, masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %v", path, err)
+	}
+	return plaintext, nil
+}
+
+//writeFileAtomic replace path with data readable by the owner only, never leaving it half written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//legacyEncrypt Encrypt as it was before keys were derived with scrypt
+func legacyEncrypt(t *testing.T, data string, passphrase string) string {
+	block, _ := aes.NewCipher([]byte(CreateHash(passphrase)))
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	return base64.RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(data), nil))
+}
+
+func TestDownloadJSONMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crypto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	masterKey := "legacy-master-key"
+	path := filepath.Join(dir, "download.json")
+	legacy := map[string]string{
+		"URL":        legacyEncrypt(t, "https://artifactory.example.com/artifactory", masterKey),
+		"Username":   legacyEncrypt(t, "admin", masterKey),
+		"Apikey":     legacyEncrypt(t, "key", masterKey),
+		"DlLocation": legacyEncrypt(t, dir, masterKey),
+	}
+	data, _ := json.Marshal(legacy)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := ReadDownloadJSON(path, masterKey)
+	if err != nil || creds.Username != "admin" || creds.Apikey != "key" {
+		t.Fatalf("expected the legacy file to be readable, got %+v (%v)", creds, err)
+	}
+	data, _ = ioutil.ReadFile(path)
+	var migrated map[string]string
+	json.Unmarshal(data, &migrated)
+	for field, value := range migrated {
+		if Legacy(value) {
+			t.Errorf("expected %s to be migrated, got %s", field, value)
+		}
+	}
+	if again, err := ReadDownloadJSON(path, masterKey); err != nil || again != creds {
+		t.Errorf("expected the migrated file to read the same, got %+v (%v)", again, err)
+	}
+}
+
+func TestCredsFileAndMasterKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crypto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	masterKey := "master-key"
+	credsFile := filepath.Join(dir, "creds")
+	ioutil.WriteFile(credsFile, []byte("user1 key1\nuser2 key2\n"), 0600)
+	if err := EncryptCredsFile(credsFile, masterKey); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(credsFile); strings.Contains(string(data), "key1") {
+		t.Error("expected the creds file to be encrypted")
+	}
+	if data, err := ReadCredsFile(credsFile, masterKey); err != nil || string(data) != "user1 key1\nuser2 key2\n" {
+		t.Errorf("expected the creds back, got %q (%v)", data, err)
+	}
+	if _, err := ReadCredsFile(credsFile, "another-key"); err == nil {
+		t.Error("expected the wrong master key to fail")
+	}
+
+	keyFile := filepath.Join(dir, "master.key")
+	if err := ProtectMasterKey(keyFile, masterKey, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("PKGDL_PASSPHRASE")
+	os.Setenv("PKGDL_PASSPHRASE", "correct horse")
+	if unlocked := VerifyMasterKey(keyFile); unlocked != masterKey {
+		t.Errorf("expected the master key to be unlocked, got %q", unlocked)
+	}
+	stored, _ := ioutil.ReadFile(keyFile)
+	os.Setenv("PKGDL_PASSPHRASE", "wrong")
+	if _, err := unlockMasterKey(string(stored)); err == nil {
+		t.Error("expected the wrong passphrase to fail")
+	}
+}
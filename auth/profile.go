@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//DefaultProfile the profile kept in download.json, used when no -profile is given
+const DefaultProfile = "default"
+
+//profileName what a profile may be called, it ends up in a file name
+var profileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+//ValidProfile check a profile name can be stored
+func ValidProfile(name string) error {
+	if !profileName.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q, use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+//ProfilePath the encrypted config of profile name under configPath. The default profile is download.json,
+//every other one is kept in profiles/<name>.json in the same format
+func ProfilePath(configPath string, name string) string {
+	if name == "" || name == DefaultProfile {
+		return filepath.Join(configPath, "download.json")
+	}
+	return filepath.Join(configPath, "profiles", name+".json")
+}
+
+//Profiles names of the profiles configured under configPath, the default one first
+func Profiles(configPath string) ([]string, error) {
+	var names []string
+	if _, err := os.Stat(ProfilePath(configPath, DefaultProfile)); err == nil {
+		names = append(names, DefaultProfile)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(configPath, "profiles"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var named []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
+			named = append(named, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	sort.Strings(named)
+	return append(names, named...), nil
+}
+
+//AddProfile prompt for the credentials of a new profile
+func AddProfile(configPath string, name string, masterKey string) (Creds, error) {
+	if err := ValidProfile(name); err != nil {
+		return Creds{}, err
+	}
+	path := ProfilePath(configPath, name)
+	if _, err := os.Stat(path); err == nil {
+		return Creds{}, fmt.Errorf("profile %s already exists, use -profile %s -reset to change it", name, name)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return Creds{}, err
+	}
+	return GenerateDownloadJSON(path, false, masterKey), nil
+}
+
+//RemoveProfile delete a profile. The default one is kept, -reset changes it instead
+func RemoveProfile(configPath string, name string) error {
+	if name == DefaultProfile {
+		return fmt.Errorf("the %s profile can't be removed, use -reset to change it", DefaultProfile)
+	}
+	if err := ValidProfile(name); err != nil {
+		return err
+	}
+	err := os.Remove(ProfilePath(configPath, name))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no profile %s", name)
+	}
+	return err
+}
+
+//Redact a secret for display, showing only whether it is set
+func Redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "********"
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	masterKey := "0123456789abcdef0123456789abcdef"
+	writeFileDownloadJSON(ProfilePath(dir, DefaultProfile), "https://prod.example.com/artifactory", "admin", "key", dir, masterKey)
+	os.MkdirAll(filepath.Join(dir, "profiles"), 0700)
+	for _, name := range []string{"staging", "dr"} {
+		writeFileDownloadJSON(ProfilePath(dir, name), "https://"+name+".example.com/artifactory", "", "token", dir, masterKey)
+	}
+
+	names, err := Profiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{DefaultProfile, "dr", "staging"}) {
+		t.Errorf("unexpected profiles %v", names)
+	}
+	creds, err := ReadDownloadJSON(ProfilePath(dir, "staging"), masterKey)
+	if err != nil || creds.URL != "https://staging.example.com/artifactory" || creds.Token != "token" {
+		t.Errorf("unexpected staging profile %+v (%v)", creds, err)
+	}
+
+	if err := RemoveProfile(dir, DefaultProfile); err == nil {
+		t.Error("expected the default profile to be kept")
+	}
+	if err := RemoveProfile(dir, "dr"); err != nil {
+		t.Error(err)
+	}
+	if err := RemoveProfile(dir, "../download"); err == nil {
+		t.Error("expected a profile name with a path to be rejected")
+	}
+	if names, _ := Profiles(dir); len(names) != 2 {
+		t.Errorf("expected dr to be removed, got %v", names)
+	}
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//tokenRefreshWindow how long before it expires an access token is refreshed
+const tokenRefreshWindow = 5 * time.Minute
+
+//tokenRefreshBackoff how long after a failed refresh the token endpoint is left alone
+const tokenRefreshBackoff = time.Minute
+
+//refreshableToken an access token that is refreshed through Artifactory's token endpoint once it expires
+type refreshableToken struct {
+	mu      sync.Mutex
+	url     string
+	access  string
+	refresh string
+	expires time.Time
+	saved   func(access string, refresh string)
+	//failed when the last refresh failed, zero once one succeeds
+	failed time.Time
+}
+
+//tokens refreshable access tokens, by the token they were configured with
+var tokens = struct {
+	sync.Mutex
+	byOriginal map[string]*refreshableToken
+}{byOriginal: make(map[string]*refreshableToken)}
+
+//SetRefreshToken refresh accessToken with refreshToken through the token endpoint of the Artifactory at urlInput
+//once it expires, or is about to. saved, if not nil, is told of every new pair of tokens so they can be persisted
+func SetRefreshToken(urlInput string, accessToken string, refreshToken string, saved func(access string, refresh string)) {
+	token := &refreshableToken{url: urlInput, access: accessToken, refresh: refreshToken, saved: saved}
+	token.expires, _ = TokenExpiry(accessToken)
+	tokens.Lock()
+	tokens.byOriginal[accessToken] = token
+	tokens.Unlock()
+}
+
+func refreshable(accessToken string) *refreshableToken {
+	tokens.Lock()
+	defer tokens.Unlock()
+	return tokens.byOriginal[accessToken]
+}
+
+//setAuth basic auth, or bearer auth when there is no username and apiKey is an access token
+func setAuth(ctx context.Context, req *http.Request, userName string, apiKey string) {
+	if userName != "" || apiKey == "" {
+		req.SetBasicAuth(userName, apiKey)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+bearerToken(ctx, apiKey))
+}
+
+//bearerToken the access token to send for apiKey, its current refreshed token if it is refreshable
+func bearerToken(ctx context.Context, apiKey string) string {
+	if token := refreshable(apiKey); token != nil {
+		return token.current(ctx)
+	}
+	return apiKey
+}
+
+//current the access token to send, refreshed first if it is about to expire
+func (t *refreshableToken) current(ctx context.Context) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.expires.IsZero() && time.Until(t.expires) < tokenRefreshWindow && t.backedOff() {
+		t.refreshOrBackOff(ctx)
+	}
+	return t.access
+}
+
+//backedOff whether the last failed refresh, if any, was long enough ago to try again
+func (t *refreshableToken) backedOff() bool {
+	return t.failed.IsZero() || time.Since(t.failed) >= tokenRefreshBackoff
+}
+
+//refreshOrBackOff refresh the token, on failure holding off further refreshes for tokenRefreshBackoff
+func (t *refreshableToken) refreshOrBackOff(ctx context.Context) {
+	if err := t.refreshLocked(ctx); err != nil {
+		log.Error("Refreshing the access token failed, retrying in ", tokenRefreshBackoff, ": ", err)
+		t.failed = time.Now()
+		return
+	}
+	t.failed = time.Time{}
+}
+
+//rejected refresh the token after a request made with sent got a 401, unless another request already replaced sent.
+//Returns true if there is a newer token to retry with
+func (t *refreshableToken) rejected(ctx context.Context, urlInput string, sent string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.access != sent {
+		return true
+	}
+	if !t.backedOff() {
+		return false
+	}
+	log.Warn("Access token rejected on ", urlInput, ", refreshing it")
+	t.refreshOrBackOff(ctx)
+	return t.access != sent
+}
+
+//tokenResponse what the token endpoint returns
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+func (t *refreshableToken) refreshLocked(ctx context.Context) error {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", t.refresh)
+	form.Set("access_token", t.access)
+	req, err := http.NewRequestWithContext(ctx, "POST", t.url+"/api/security/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	var refreshed tokenResponse
+	if err := json.Unmarshal(data, &refreshed); err != nil {
+		return err
+	}
+	if refreshed.AccessToken == "" {
+		return errors.New("no access token in the response")
+	}
+	t.access = refreshed.AccessToken
+	if refreshed.RefreshToken != "" {
+		t.refresh = refreshed.RefreshToken
+	}
+	t.expires = time.Time{}
+	if refreshed.ExpiresIn > 0 {
+		t.expires = time.Now().Add(time.Duration(refreshed.ExpiresIn) * time.Second)
+	}
+	log.Info("Access token refreshed")
+	if t.saved != nil {
+		t.saved(t.access, t.refresh)
+	}
+	return nil
+}
+
+//TokenExpiry when a JWT access token expires. Reference tokens are opaque and have no known expiry
+func TokenExpiry(accessToken string) (time.Time, bool) {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+//tokenRejected handle a 401 for a request that sent the bearer token sent for accessToken, returns true if the token
+//was refreshed and the request is worth retrying
+func tokenRejected(ctx context.Context, urlInput string, accessToken string, sent string, headers http.Header) bool {
+	if token := refreshable(accessToken); token != nil {
+		return token.rejected(ctx, urlInput, sent)
+	}
+	expires, known := TokenExpiry(sent)
+	if (known && time.Now().After(expires)) || strings.Contains(strings.ToLower(headers.Get("WWW-Authenticate")), "expired") {
+		log.Error("Access token expired on ", urlInput, ", set -refreshtoken to refresh it automatically")
+	} else {
+		log.Error("Access token rejected on ", urlInput)
+	}
+	return false
+}
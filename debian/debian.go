@@ -1,10 +1,14 @@
 package debian
 
 import (
-	"container/list"
+	"context"
+	"encoding/json"
 	"fmt"
+	"go-pkgdl/auth"
 	"go-pkgdl/helpers"
-	"net/http"
+	"go-pkgdl/journal"
+	"go-pkgdl/pkgtype"
+	"io"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -21,11 +25,57 @@ type Metadata struct {
 	File         string
 }
 
+//Key repository path of the Debian artifact
+func (md Metadata) Key() string {
+	return md.URL
+}
+
+//Plugin debian package type
+type Plugin struct{}
+
+func init() {
+	pkgtype.Register("debian", Plugin{})
+}
+
+//Crawl walk the pool/ tree of the upstream
+func (Plugin) Crawl(ctx context.Context, env pkgtype.Env, sink pkgtype.Sink) {
+	GetDebianHrefs(ctx, env.URL+"pool/", env.Base, 1, "", sink, env.Journal)
+}
+
+//Decode a Metadata journaled by an earlier run
+func (Plugin) Decode(data []byte) (interface{}, error) {
+	var md Metadata
+	err := json.Unmarshal(data, &md)
+	return md, err
+}
+
+//Fetch download the .deb and set its deb.* properties in the cache
+func (Plugin) Fetch(ctx context.Context, env pkgtype.Env, item interface{}, workerNum int) error {
+	md := item.(Metadata)
+	creds := env.Creds
+	if err := pkgtype.StandardDownload(ctx, env, md.URL, md.File, auth.Checksum{}); err != nil {
+		return err
+	}
+	propertiesURL := creds.URL + "/api/storage/" + env.Flags.RepoVar + "-cache" + md.URL + "?properties=deb.component=" + md.Component + ";deb.architecture=" + md.Architecture + ";deb.distribution=" + md.Distribution
+	_, statusCode, _ := auth.GetRestAPI(ctx, "PUT", true, propertiesURL, creds.Username, creds.Apikey, "", nil, 1)
+	return auth.CheckStatus("PUT", propertiesURL, statusCode)
+}
+
 //GetDebianHrefs parse hrefs for Debian files
-func GetDebianHrefs(url string, base string, index int, component string, debianWorkerQueue *list.List) string {
-	resp, err := http.Get(url)
+func GetDebianHrefs(ctx context.Context, url string, base string, index int, component string, debianWorkerQueue pkgtype.Sink, jrnl *journal.Journal) string {
+	if ctx.Err() != nil {
+		return ""
+	}
+	if jrnl.Visited(url) {
+		log.Debug("skipping ", url, ", already crawled")
+		return ""
+	}
+	resp, err := auth.Get(ctx, url)
 	// this needs to be threaded better..
 	helpers.Check(err, false, "HTTP GET error", helpers.Trace())
+	if err != nil {
+		return ""
+	}
 	defer resp.Body.Close()
 
 	log.Debug(resp) //output from HTML download
@@ -37,6 +87,9 @@ func GetDebianHrefs(url string, base string, index int, component string, debian
 		switch {
 		case tt == html.ErrorToken:
 			// End of the document, we're done
+			if z.Err() == io.EOF && ctx.Err() == nil {
+				jrnl.MarkVisited(url)
+			}
 			return ""
 		case tt == html.StartTagToken:
 			t := z.Token()
@@ -51,7 +104,7 @@ func GetDebianHrefs(url string, base string, index int, component string, debian
 						if index == 1 {
 							component = strings.TrimSuffix(a.Val, "/")
 						}
-						GetDebianHrefs(url+a.Val, base, index+1, component, debianWorkerQueue)
+						GetDebianHrefs(ctx, url+a.Val, base, index+1, component, debianWorkerQueue, jrnl)
 						break
 					}
 				}
@@ -62,7 +115,7 @@ func GetDebianHrefs(url string, base string, index int, component string, debian
 	}
 }
 
-func checkDebian(t html.Token, url string, base string, component string, debianWorkerQueue *list.List) {
+func checkDebian(t html.Token, url string, base string, component string, debianWorkerQueue pkgtype.Sink) {
 	if strings.Contains(t.String(), ".deb") {
 		for _, a := range t.Attr {
 			if a.Key == "href" && (strings.HasSuffix(a.Val, ".deb")) {
@@ -81,7 +134,7 @@ func checkDebian(t html.Token, url string, base string, component string, debian
 				debianMd.Architecture = arch
 				debianMd.Distribution = dist
 				debianMd.File = a.Val
-				debianWorkerQueue.PushBack(debianMd)
+				debianWorkerQueue.Push(debianMd)
 				break
 			}
 		}
@@ -1,15 +1,16 @@
 package docker
 
 import (
-	"container/list"
 	"context"
 	"encoding/json"
 	"fmt"
 	"go-pkgdl/auth"
 	"go-pkgdl/helpers"
+	"go-pkgdl/logging"
+	"go-pkgdl/pkgtype"
+	"go-pkgdl/stats"
 
 	"strings"
-	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
@@ -44,14 +45,43 @@ type Metadata struct {
 	Tag             string
 }
 
+//Key image:tag
+func (md Metadata) Key() string {
+	return md.Image + ":" + md.Tag
+}
+
+//Plugin docker package type
+type Plugin struct{}
+
+func init() {
+	pkgtype.Register("docker", Plugin{})
+}
+
+//Crawl search Docker Hub and list tags through the remote
+func (Plugin) Crawl(ctx context.Context, env pkgtype.Env, sink pkgtype.Sink) {
+	log.Warn("Work in progress, only works against Docker Hub")
+	GetDockerImages(ctx, env.Creds.URL, env.Creds.Username, env.Creds.Apikey, env.Flags.RepoVar, env.URL, env.Base, 1, "", sink, env.Flags)
+}
+
+//Decode a Metadata journaled by an earlier run
+func (Plugin) Decode(data []byte) (interface{}, error) {
+	var md Metadata
+	err := json.Unmarshal(data, &md)
+	return md, err
+}
+
+//Fetch pull the manifest and layers of an image tag
+func (Plugin) Fetch(ctx context.Context, env pkgtype.Env, item interface{}, workerNum int) error {
+	return DlDockerLayers(ctx, env.Creds, item.(Metadata), env.Flags.RepoVar, workerNum, false)
+}
+
 //GetDockerImages Docker Engine API search
-func GetDockerImages(artURL string, artUser string, artApikey string, dockerRepo string, url string, base string, index int, component string, dockerWorkerQueue *list.List, flags helpers.Flags) string {
+func GetDockerImages(ctx context.Context, artURL string, artUser string, artApikey string, dockerRepo string, url string, base string, index int, component string, dockerWorkerQueue pkgtype.Sink, flags helpers.Flags) string {
 
 	//search upstream only
 
 	//search internet
 	//https://github.com/moby/moby/blob/master/client/image_search.go#L17
-	ctx := context.Background()
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		log.Error("Docker CLI init error")
@@ -64,6 +94,8 @@ func GetDockerImages(artURL string, artUser string, artApikey string, dockerRepo
 		Limit:   100,
 	}
 	randomSearchMap := make(map[string]string)
+	//searches overlap, only list the tags of an image once
+	listed := make(map[string]bool)
 
 	//search for docker images via looping through permuations of two letters, alpabetised
 	for i := 33; i <= 58; i++ {
@@ -72,11 +104,14 @@ func GetDockerImages(artURL string, artUser string, artApikey string, dockerRepo
 			randomSearchMap[dockerSearchStr] = "taken"
 			if !flags.RandomVar {
 				log.Debug("Docker ordered search key:", dockerSearchStr)
+				if ctx.Err() != nil {
+					return ""
+				}
 				results, err := cli.ImageSearch(ctx, dockerSearchStr, imageSearch)
 				if err != nil {
 					log.Error("Docker image search error:", err)
 				}
-				dockerSearch(dockerSearchStr, results, artURL, artUser, artApikey, dockerRepo, dockerWorkerQueue, flags)
+				dockerSearch(ctx, dockerSearchStr, results, artURL, artUser, artApikey, dockerRepo, dockerWorkerQueue, flags, listed)
 			}
 		}
 	}
@@ -85,21 +120,32 @@ func GetDockerImages(artURL string, artUser string, artApikey string, dockerRepo
 	if flags.RandomVar {
 		for key, value := range randomSearchMap {
 			log.Debug("Docker Random result search Key:", key, " Value:", value)
+			if ctx.Err() != nil {
+				return ""
+			}
 			results, _ := cli.ImageSearch(ctx, key, imageSearch)
-			dockerSearch(key, results, artURL, artUser, artApikey, dockerRepo, dockerWorkerQueue, flags)
+			dockerSearch(ctx, key, results, artURL, artUser, artApikey, dockerRepo, dockerWorkerQueue, flags, listed)
 		}
 	}
 
 	return ""
 }
 
-func dockerSearch(search string, results []registry.SearchResult, artURL string, artUser string, artApikey string, dockerRepo string, dockerWorkerQueue *list.List, flags helpers.Flags) {
+func dockerSearch(ctx context.Context, search string, results []registry.SearchResult, artURL string, artUser string, artApikey string, dockerRepo string, dockerWorkerQueue pkgtype.Sink, flags helpers.Flags, listed map[string]bool) {
 	//gets name, then loops through tags
 
 	for x := range results {
+		if ctx.Err() != nil {
+			return
+		}
+		if listed[results[x].Name] {
+			log.Trace("Docker already listed tags of ", results[x].Name)
+			continue
+		}
+		listed[results[x].Name] = true
 		var tags dockerTagMetadata
 		// can probably hit artifactory harder with this call
-		data, _, _ := auth.GetRestAPI("GET", true, artURL+"/api/docker/"+dockerRepo+"/v2/"+results[x].Name+"/tags/list", artUser, artApikey, "", nil, 1)
+		data, _, _ := auth.GetRestAPI(ctx, "GET", true, artURL+"/api/docker/"+dockerRepo+"/v2/"+results[x].Name+"/tags/list", artUser, artApikey, "", nil, 1)
 
 		err := json.Unmarshal([]byte(data), &tags)
 		if err != nil {
@@ -113,73 +159,84 @@ func dockerSearch(search string, results []registry.SearchResult, artURL string,
 			dockerMd.ManifestURLAPI = artURL + "/api/docker/" + dockerRepo + "/v2/" + results[x].Name + "/manifests/" + tags.Tags[y]
 			dockerMd.ManifestURLFile = artURL + "/" + dockerRepo + "/" + results[x].Name + "/" + tags.Tags[y] + "/manifest.json"
 			log.Trace("Docker Queue pushing into queue:", dockerMd.ManifestURLFile)
-			dockerWorkerQueue.PushBack(dockerMd)
-
-			for dockerWorkerQueue.Len() > flags.SleepQueueMaxVar {
-				log.Debug("Docker worker queue is at ", dockerWorkerQueue.Len(), ", queue max is set to ", flags.SleepQueueMaxVar, ", sleeping for ", flags.WorkerSleepVar, " seconds...")
-				time.Sleep(time.Duration(flags.WorkerSleepVar) * time.Second)
-			}
-			log.Trace("Queue at:", dockerWorkerQueue.Len(), ", resuming docker worker queue")
+			dockerWorkerQueue.Push(dockerMd)
 		}
 	}
 }
 
 //DlDockerLayers download docker layers
-func DlDockerLayers(creds auth.Creds, md Metadata, repo string, workerNum int, generic bool) {
+func DlDockerLayers(ctx context.Context, creds auth.Creds, md Metadata, repo string, workerNum int, generic bool) error {
+	logger := logging.FromContext(ctx)
 	m := map[string]string{
 		"Accept": "application/vnd.docker.distribution.manifest.v2+json",
 	}
-	log.Debug("Worker ", workerNum, " Getting manifest for first time:", md.ManifestURLAPI, " headers:", m)
-	manifest, _, headers := auth.GetRestAPI("GET", true, md.ManifestURLAPI, creds.Username, creds.Apikey, "", m, 1)
+	logger.Debug("Getting manifest for first time:", md.ManifestURLAPI, " headers:", m)
+	manifest, manifestStatusCode, headers := auth.GetRestAPI(ctx, "GET", true, md.ManifestURLAPI, creds.Username, creds.Apikey, "", m, 1)
+	if err := auth.CheckStatus("GET", md.ManifestURLAPI, manifestStatusCode); err != nil {
+		logger.Warn("Could not get manifest:", md.Image, ":", md.Tag, " skipping further image download due to:"+err.Error())
+		return err
+	}
 
 	var manifestData dockerManifestMetadata
 	err := json.Unmarshal(manifest, &manifestData)
 	if err != nil {
-		log.Warn("Worker ", workerNum, " error mapping manifest:", md.Image, ":", md.Tag, " skipping further image download due to:"+err.Error())
+		logger.Warn("Error mapping manifest:", md.Image, ":", md.Tag, " skipping further image download due to:"+err.Error())
 		//TODO, delete manifest maybe
-		return
+		return fmt.Errorf("mapping manifest %s:%s: %v", md.Image, md.Tag, err)
 	}
-	log.Trace("Worker ", workerNum, " Manifest data:", string(manifest), md.Image, md.Tag)
-	log.Debug("Worker ", workerNum, " Manifest recieved data:", headers, manifestData.Config.Digest, manifestData.Config.MediaType, manifestData.SchemaVersion)
+	logger.Trace("Manifest data:", string(manifest), md.Image, md.Tag)
+	logger.Debug("Manifest recieved data:", headers, manifestData.Config.Digest, manifestData.Config.MediaType, manifestData.SchemaVersion)
 	if manifestData.SchemaVersion != 2 {
-		log.Warn("Worker ", workerNum, " encountered schema version ", manifestData.SchemaVersion, " for manifest ", md.Image+":"+md.Tag, " skipping download")
-		return
+		logger.Warn("Encountered schema version ", manifestData.SchemaVersion, " for manifest ", md.Image+":"+md.Tag, " skipping download")
+		return nil
 	}
-	log.Debug("Worker ", workerNum, " Getting manifest via metadata:", md.ManifestURLAPI)
-	auth.GetRestAPI("GET", true, creds.URL+"/api/docker/"+repo+"/v2/"+md.Image+"/manifests/"+md.Tag, creds.Username, creds.Apikey, "", nil, 1)
+	logger.Debug("Getting manifest via metadata:", md.ManifestURLAPI)
+	auth.GetRestAPI(ctx, "GET", true, creds.URL+"/api/docker/"+repo+"/v2/"+md.Image+"/manifests/"+md.Tag, creds.Username, creds.Apikey, "", nil, 1)
 
 	//iterate through layer download - tried to do concurrent downloads but this usually rekts Artifactory
-	log.Info("Worker ", workerNum, " Got manifest for image ", md.Image, ":", md.Tag, " contains ", len(manifestData.FsLayers), " layers")
+	logger.Info("Got manifest for image ", md.Image, ":", md.Tag, " contains ", len(manifestData.FsLayers), " layers")
 	skippedLayers := 0
+	var layerErr error
 	for x := range manifestData.FsLayers {
 		if x%7 == 0 && x != 0 {
-			log.Info("Worker ", workerNum, " Processed ", x, " layers of image ", md.Image, ":", md.Tag)
+			logger.Info("Processed ", x, " layers of image ", md.Image, ":", md.Tag)
 		}
 		headLoc := creds.URL + "/" + repo + "-cache/" + md.Image + "/" + md.Tag + "/" + strings.Replace(manifestData.FsLayers[x].BlobSum, ":", "__", -1)
-		log.Debug("Worker ", workerNum, " Getting blob:", manifestData.FsLayers[x].BlobSum)
-		_, headStatusCode, _ := auth.GetRestAPI("HEAD", true, headLoc, creds.Username, creds.Apikey, "", nil, 1)
+		logger.Debug("Getting blob:", manifestData.FsLayers[x].BlobSum)
+		_, headStatusCode, _ := auth.GetRestAPI(ctx, "HEAD", true, headLoc, creds.Username, creds.Apikey, "", nil, 1)
 		if headStatusCode == 200 {
-			log.Trace("Worker ", workerNum, " skipping current layer ", x, "/", len(manifestData.FsLayers), " got 200 on HEAD request for ", manifestData.FsLayers[x].BlobSum)
+			logger.Trace("Skipping current layer ", x, "/", len(manifestData.FsLayers), " got 200 on HEAD request for ", manifestData.FsLayers[x].BlobSum)
+			stats.Cached()
 			skippedLayers++
 			continue
 		}
-		log.Debug("Worker ", workerNum, " Downloading blob:", manifestData.FsLayers[x].BlobSum)
+		logger.Debug("Downloading blob:", manifestData.FsLayers[x].BlobSum)
 		blobDownload := ""
 		if generic {
 			blobDownload = creds.URL + "/" + repo + "/" + md.Image + "/" + md.Tag + "/" + strings.Replace(manifestData.FsLayers[x].BlobSum, ":", "__", -1)
-			sha256, _, _ := auth.GetRestAPI("GET", true, creds.URL+"/"+repo+"-cache/"+md.Image+"/"+md.Tag+"/manifest.json.sha256", creds.Username, creds.Apikey, "", nil, 1)
-			auth.GetRestAPI("PUT", true, creds.URL+"/api/storage/"+repo+"-cache/"+md.Image+"/"+md.Tag+"/manifest.json?properties=docker.manifest.digest=sha256:"+string(sha256)+";sha256="+string(sha256), creds.Username, creds.Apikey, "", nil, 1)
+			sha256, _, _ := auth.GetRestAPI(ctx, "GET", true, creds.URL+"/"+repo+"-cache/"+md.Image+"/"+md.Tag+"/manifest.json.sha256", creds.Username, creds.Apikey, "", nil, 1)
+			auth.GetRestAPI(ctx, "PUT", true, creds.URL+"/api/storage/"+repo+"-cache/"+md.Image+"/"+md.Tag+"/manifest.json?properties=docker.manifest.digest=sha256:"+string(sha256)+";sha256="+string(sha256), creds.Username, creds.Apikey, "", nil, 1)
 		} else {
 			blobDownload = creds.URL + "/api/docker/" + repo + "/v2/" + md.Image + "/blobs/" + manifestData.FsLayers[x].BlobSum
 		}
-		auth.GetRestAPI("GET", true, blobDownload, creds.Username, creds.Apikey, "", nil, 1)
+		//layers are content addressed, their digest is the checksum to verify
+		var expected auth.Checksum
+		if digest := strings.SplitN(manifestData.FsLayers[x].BlobSum, ":", 2); len(digest) == 2 {
+			expected = auth.Checksum{Algorithm: digest[0], Value: digest[1]}
+		}
+		if _, _, err := auth.Download(ctx, true, blobDownload, creds.Username, creds.Apikey, auth.Discard, expected); err != nil {
+			logger.Warn("Failed getting blob:", manifestData.FsLayers[x].BlobSum, " ", err)
+			layerErr = err
+			continue
+		}
 		if generic {
-			auth.GetRestAPI("PUT", true, creds.URL+"/api/storage/"+repo+"-cache/"+md.Image+"/"+md.Tag+"/"+strings.Replace(manifestData.FsLayers[x].BlobSum, ":", "__", -1)+"?properties=sha256="+strings.Replace(manifestData.FsLayers[x].BlobSum, "sha256:", "", -1), creds.Username, creds.Apikey, "", nil, 1)
-			auth.GetRestAPI("GET", true, creds.URL+"/api/docker/"+repo+"/v2/"+md.Image+"/blobs/"+manifestData.FsLayers[x].BlobSum, creds.Username, creds.Apikey, "", nil, 1)
+			auth.GetRestAPI(ctx, "PUT", true, creds.URL+"/api/storage/"+repo+"-cache/"+md.Image+"/"+md.Tag+"/"+strings.Replace(manifestData.FsLayers[x].BlobSum, ":", "__", -1)+"?properties=sha256="+strings.Replace(manifestData.FsLayers[x].BlobSum, "sha256:", "", -1), creds.Username, creds.Apikey, "", nil, 1)
+			auth.GetRestAPI(ctx, "GET", true, creds.URL+"/api/docker/"+repo+"/v2/"+md.Image+"/blobs/"+manifestData.FsLayers[x].BlobSum, creds.Username, creds.Apikey, "", nil, 1)
 
 		}
 		//TODO maybe some error code if the layers aren't fetching
-		log.Debug("Worker ", workerNum, " Finished Getting blob:", manifestData.FsLayers[x].BlobSum)
+		logger.Debug("Finished Getting blob:", manifestData.FsLayers[x].BlobSum)
 	}
-	log.Info("Worker ", workerNum, " Finished downloading image:", md.Image, ":", md.Tag, ", skipped ", skippedLayers, "/", len(manifestData.FsLayers), " layers as they already existed")
+	logger.Info("Finished downloading image:", md.Image, ":", md.Tag, ", skipped ", skippedLayers, "/", len(manifestData.FsLayers), " layers as they already existed")
+	return layerErr
 }
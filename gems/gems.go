@@ -1,14 +1,15 @@
 package gems
 
 import (
-	"container/list"
+	"context"
 	"encoding/json"
 	"fmt"
 	"go-pkgdl/auth"
 	"go-pkgdl/helpers"
+	"go-pkgdl/journal"
+	"go-pkgdl/pkgtype"
 	"strconv"
 	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -20,11 +21,42 @@ type Metadata struct {
 	Name string
 }
 
-func GetGemsHrefs(creds auth.Creds, url string, base string, gemsWorkerQueue *list.List, flags helpers.Flags) {
-	GetGems(creds, flags, gemsWorkerQueue, url, base)
+//Key repository path of the gem artifact
+func (md Metadata) Key() string {
+	return md.URL
 }
 
-func GetGems(creds auth.Creds, flags helpers.Flags, gemsWorkerQueue *list.List, url string, base string) {
+//Plugin gems package type
+type Plugin struct{}
+
+func init() {
+	pkgtype.Register("gems", Plugin{})
+}
+
+//Crawl search rubygems for gems
+func (Plugin) Crawl(ctx context.Context, env pkgtype.Env, sink pkgtype.Sink) {
+	log.Info("ruby takes 10 seconds to init, please be patient")
+	GetGemsHrefs(ctx, env.Creds, env.URL, env.Base, sink, env.Flags, env.Journal)
+}
+
+//Decode a Metadata journaled by an earlier run
+func (Plugin) Decode(data []byte) (interface{}, error) {
+	var md Metadata
+	err := json.Unmarshal(data, &md)
+	return md, err
+}
+
+//Fetch download the .gem
+func (Plugin) Fetch(ctx context.Context, env pkgtype.Env, item interface{}, workerNum int) error {
+	md := item.(Metadata)
+	return pkgtype.StandardDownload(ctx, env, md.URL, md.File, auth.Checksum{})
+}
+
+func GetGemsHrefs(ctx context.Context, creds auth.Creds, url string, base string, gemsWorkerQueue pkgtype.Sink, flags helpers.Flags, jrnl *journal.Journal) {
+	GetGems(ctx, creds, flags, gemsWorkerQueue, url, base, jrnl)
+}
+
+func GetGems(ctx context.Context, creds auth.Creds, flags helpers.Flags, gemsWorkerQueue pkgtype.Sink, url string, base string, jrnl *journal.Journal) {
 	randomSearchMap := make(map[string]string)
 
 	//search for gems via looping through permuations of two letters, alpabetised
@@ -34,7 +66,10 @@ func GetGems(creds auth.Creds, flags helpers.Flags, gemsWorkerQueue *list.List,
 			randomSearchMap[gemsSearchStr] = "taken"
 			if !flags.RandomVar {
 				log.Debug("Ruby ordered search key:", gemsSearchStr)
-				gemsSearch(creds, flags, gemsWorkerQueue, url, base, gemsSearchStr)
+				if ctx.Err() != nil {
+					return
+				}
+				gemsSearch(ctx, creds, flags, gemsWorkerQueue, url, base, gemsSearchStr, jrnl)
 			}
 		}
 	}
@@ -43,7 +78,10 @@ func GetGems(creds auth.Creds, flags helpers.Flags, gemsWorkerQueue *list.List,
 	if flags.RandomVar {
 		for key, value := range randomSearchMap {
 			log.Debug("Ruby Random result search Key:", key, " Value:", value)
-			gemsSearch(creds, flags, gemsWorkerQueue, url, base, key)
+			if ctx.Err() != nil {
+				return
+			}
+			gemsSearch(ctx, creds, flags, gemsWorkerQueue, url, base, key, jrnl)
 		}
 	}
 }
@@ -53,13 +91,25 @@ type gemData struct {
 	GemName string `json:"name"`
 }
 
-func gemsSearch(creds auth.Creds, flags helpers.Flags, gemsWorkerQueue *list.List, url string, base string, gemsSearchStr string) {
+func gemsSearch(ctx context.Context, creds auth.Creds, flags helpers.Flags, gemsWorkerQueue pkgtype.Sink, url string, base string, gemsSearchStr string, jrnl *journal.Journal) {
 	//TODO, search query is paginated for more results
 	pg := 1
-	for {
-		data, _, _ := auth.GetRestAPI("GET", false, url+"api/v1/search.json?query="+gemsSearchStr+"&page="+strconv.Itoa(pg), "", "", "", nil, 0)
+	cursorKey := "search:" + gemsSearchStr
+	if cursor, ok := jrnl.Cursor(cursorKey); ok {
+		if cursor == "done" {
+			log.Debug("journal has search key ", gemsSearchStr, " as done, skipping")
+			return
+		}
+		if page, err := strconv.Atoi(cursor); err == nil {
+			log.Info("resuming search key ", gemsSearchStr, " from page ", page)
+			pg = page
+		}
+	}
+	for ctx.Err() == nil {
+		data, _, _ := auth.GetRestAPI(ctx, "GET", false, url+"api/v1/search.json?query="+gemsSearchStr+"&page="+strconv.Itoa(pg), "", "", "", nil, 0)
 		if string(data) == "[]" {
 			log.Info("no more pages for ", gemsSearchStr, " moving on to next key")
+			jrnl.SetCursor(cursorKey, "done")
 			return
 		}
 		var gemSearchApiData []gemData
@@ -73,12 +123,9 @@ func gemsSearch(creds auth.Creds, flags helpers.Flags, gemsWorkerQueue *list.Lis
 			var GemsMd Metadata
 			GemsMd.URL = strings.TrimPrefix(gemSearchApiData[i].GemUri, base)
 			GemsMd.File = gemSearchApiData[i].GemName
-			if gemsWorkerQueue.Len() > flags.SleepQueueMaxVar {
-				log.Debug("Gems worker queue is at ", gemsWorkerQueue.Len(), ", sleeping for ", flags.WorkerSleepVar, " seconds...")
-				time.Sleep(time.Duration(flags.WorkerSleepVar) * time.Second)
-			}
-			gemsWorkerQueue.PushBack(GemsMd)
+			gemsWorkerQueue.Push(GemsMd)
 		}
 		pg++
+		jrnl.SetCursor(cursorKey, strconv.Itoa(pg))
 	}
 }
@@ -2,11 +2,18 @@ package generic
 
 import (
 	"bytes"
-	"container/list"
+	"context"
+	"encoding/json"
 	"fmt"
 	"go-pkgdl/auth"
 	"go-pkgdl/docker"
 	"go-pkgdl/helpers"
+	"go-pkgdl/journal"
+	"go-pkgdl/logging"
+	"go-pkgdl/mirror"
+	"go-pkgdl/pkgtype"
+	"go-pkgdl/stats"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -28,28 +35,71 @@ type Metadata struct {
 	Tag             string
 }
 
+//Key manifest or file path, or the generated file name for local repositories
+func (md Metadata) Key() string {
+	if md.ManifestURLFile != "" {
+		return md.ManifestURLFile
+	}
+	if md.URL != "" {
+		return md.URL
+	}
+	return md.File
+}
+
+//Plugin generic package type
+type Plugin struct{}
+
+func init() {
+	pkgtype.Register("generic", Plugin{})
+}
+
+//Crawl walk the upstream directory listing, or generate files for a local repository
+func (Plugin) Crawl(ctx context.Context, env pkgtype.Env, sink pkgtype.Sink) {
+	log.Warn("Work in progress")
+	log.Debug("Extraced URL:", env.URL, " stripped:", env.Base)
+	//TODO: if url does not end in /, it messes up
+	GetGenericHrefs(ctx, env.URL, env.Base, sink, env.Flags.RepoVar, env.Flags, env.Journal)
+}
+
+//Decode a Metadata journaled by an earlier run
+func (Plugin) Decode(data []byte) (interface{}, error) {
+	var md Metadata
+	err := json.Unmarshal(data, &md)
+	return md, err
+}
+
+//Fetch download the file, or the docker image it describes
+func (Plugin) Fetch(ctx context.Context, env pkgtype.Env, item interface{}, workerNum int) error {
+	md := item.(Metadata)
+	return GenericDownload(ctx, env.Creds, md, env.DownloadPath(md.File), env.Flags, workerNum)
+	//CreateAndUploadFile(ctx, env.Creds, item.(Metadata), env.Flags, env.ConfigPath, env.DlFolder, workerNum)
+}
+
 //GetGenericHrefs parse hrefs for Generic files
-func GetGenericHrefs(url string, base string, GenericWorkerQueue *list.List, genericRepo string, flags helpers.Flags) string {
+func GetGenericHrefs(ctx context.Context, url string, base string, GenericWorkerQueue pkgtype.Sink, genericRepo string, flags helpers.Flags, jrnl *journal.Journal) string {
+	if ctx.Err() != nil {
+		return ""
+	}
+	if jrnl.Visited(url) {
+		log.Debug("skipping ", url, ", already crawled")
+		return ""
+	}
 	if url == "" {
 		//must be a local repo, send to generic file generator instead
-		for {
-			if GenericWorkerQueue.Len() > 10000 {
-				log.Debug("Generic worker queue is at ", GenericWorkerQueue.Len(), ", sleeping for ", flags.WorkerSleepVar, " seconds...")
-				time.Sleep(time.Duration(flags.WorkerSleepVar) * time.Second)
-			}
+		for ctx.Err() == nil {
 			randomString := RandStringBytesMaskImprSrcSB(10)
 			var GenericMd Metadata
 			GenericMd.URL = ""
 			GenericMd.File = randomString
-			GenericWorkerQueue.PushBack(GenericMd)
-
+			GenericWorkerQueue.Push(GenericMd)
 		}
+		return ""
 	} else {
 		needAuth := false
 		if flags.UpstreamUsernameVar != "" {
 			needAuth = true
 		}
-		respdata, _, _ := auth.GetRestAPI("GET", needAuth, url, flags.UpstreamUsernameVar, flags.UpstreamApikeyVar, "", nil, 2)
+		respdata, _, _ := auth.GetRestAPI(ctx, "GET", needAuth, url, flags.UpstreamUsernameVar, flags.UpstreamApikeyVar, "", nil, 2)
 		//resp, err := http.Get(url)
 		// this needs to be threaded better..
 		//helpers.Check(err, false, "HTTP GET error", helpers.Trace())
@@ -67,6 +117,9 @@ func GetGenericHrefs(url string, base string, GenericWorkerQueue *list.List, gen
 			switch {
 			case tt == html.ErrorToken:
 				// End of the document, we're done
+				if z.Err() == io.EOF && ctx.Err() == nil {
+					jrnl.MarkVisited(url)
+				}
 				return ""
 			case tt == html.StartTagToken:
 				t := z.Token()
@@ -78,7 +131,7 @@ func GetGenericHrefs(url string, base string, GenericWorkerQueue *list.List, gen
 						if a.Key == "href" && (strings.HasSuffix(a.Val, "/")) {
 
 							strip := strings.TrimPrefix(a.Val, ":")
-							GetGenericHrefs(url+strip, base, GenericWorkerQueue, genericRepo, flags)
+							GetGenericHrefs(ctx, url+strip, base, GenericWorkerQueue, genericRepo, flags, jrnl)
 							break
 						}
 					}
@@ -89,7 +142,7 @@ func GetGenericHrefs(url string, base string, GenericWorkerQueue *list.List, gen
 	}
 }
 
-func checkGeneric(t html.Token, url string, base string, GenericWorkerQueue *list.List, genericRepo string, flags helpers.Flags) {
+func checkGeneric(t html.Token, url string, base string, GenericWorkerQueue pkgtype.Sink, genericRepo string, flags helpers.Flags) {
 	//need to consider downloading pom.xml too TODO fix for generic
 	if strings.Contains(t.String(), "manifest.json") {
 		for _, a := range t.Attr {
@@ -111,13 +164,7 @@ func checkGeneric(t html.Token, url string, base string, GenericWorkerQueue *lis
 				GenericMd.ManifestURLFile = flags.URLVar + "/" + genericRepo + "/" + GenericMd.Image + "/" + GenericMd.Tag + "/manifest.json"
 				log.Info("Generic Docker Queue pushing into queue:", GenericMd.ManifestURLFile)
 				log.Debug("Generic Docker Queue pushing:", GenericMd.Image, " tag:", GenericMd.Tag)
-				GenericWorkerQueue.PushBack(GenericMd)
-
-				for GenericWorkerQueue.Len() > 75 {
-					log.Debug("Generic worker queue is at ", GenericWorkerQueue.Len(), ", sleeping for ", flags.WorkerSleepVar, " seconds...")
-					time.Sleep(time.Duration(flags.WorkerSleepVar) * time.Second)
-				}
-				log.Trace("Queue at:", GenericWorkerQueue.Len(), ", resuming generic worker queue")
+				GenericWorkerQueue.Push(GenericMd)
 				break
 			}
 		}
@@ -135,7 +182,7 @@ func checkGeneric(t html.Token, url string, base string, GenericWorkerQueue *lis
 				var GenericMd Metadata
 				GenericMd.URL = strings.Replace(href, ":", "", -1)
 				GenericMd.File = strings.TrimPrefix(a.Val, ":")
-				GenericWorkerQueue.PushBack(GenericMd)
+				GenericWorkerQueue.Push(GenericMd)
 				break
 			}
 		}
@@ -143,19 +190,20 @@ func checkGeneric(t html.Token, url string, base string, GenericWorkerQueue *lis
 }
 
 //CreateAndUploadFile generate random string, and upload it to repo
-func CreateAndUploadFile(creds auth.Creds, md Metadata, flags helpers.Flags, configPath string, dlFolder string, i int) {
+func CreateAndUploadFile(ctx context.Context, creds auth.Creds, md Metadata, flags helpers.Flags, configPath string, dlFolder string, i int) {
 	err := ioutil.WriteFile(configPath+dlFolder+"/"+"file-"+md.File, []byte(md.File), 0644)
 	helpers.Check(err, true, "Generating "+md.File+" file", helpers.Trace())
-	log.Info("Worker ", i, " Uploading file:", configPath+dlFolder+"/"+"file-"+md.File)
+	logger := logging.FromContext(ctx)
+	logger.Info("Uploading file:", configPath+dlFolder+"/"+"file-"+md.File)
 
 	// headerMap := map[string]string{
 	// 	"Content-Type": "text/plain",
 	// }
 
-	body, _, _ := auth.GetRestAPI("PUT", true, creds.URL+"/"+flags.RepoVar+"/uploads/"+md.File+"/"+"file-"+md.File, creds.Username, creds.Apikey, configPath+dlFolder+"/"+"file-"+md.File, nil, 0)
+	body, _, _ := auth.GetRestAPI(ctx, "PUT", true, creds.URL+"/"+flags.RepoVar+"/uploads/"+md.File+"/"+"file-"+md.File, creds.Username, creds.Apikey, configPath+dlFolder+"/"+"file-"+md.File, nil, 0)
 	log.Debug("upload returned:", string(body))
 	os.Remove(configPath + dlFolder + "/" + "file-" + md.File)
-	log.Info("Worker ", i, " Finished Uploading file:", configPath+dlFolder+"/"+"file-"+md.File)
+	logger.Info("Finished Uploading file:", configPath+dlFolder+"/"+"file-"+md.File)
 }
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -186,7 +234,8 @@ func RandStringBytesMaskImprSrcSB(n int) string {
 	return sb.String()
 }
 
-func GenericDownload(creds auth.Creds, md Metadata, configPath string, pkgRepoDlFolder string, repoVar string, i int) {
+func GenericDownload(ctx context.Context, creds auth.Creds, md Metadata, dlPath string, flags helpers.Flags, i int) error {
+	repoVar := flags.RepoVar
 
 	if md.ManifestURLAPI != "" {
 		var dockerMd docker.Metadata
@@ -194,16 +243,26 @@ func GenericDownload(creds auth.Creds, md Metadata, configPath string, pkgRepoDl
 		dockerMd.ManifestURLAPI = md.ManifestURLAPI
 		dockerMd.ManifestURLFile = md.ManifestURLFile
 		dockerMd.Tag = md.Tag
-		docker.DlDockerLayers(creds, dockerMd, repoVar, i, true)
+		if err := docker.DlDockerLayers(ctx, creds, dockerMd, repoVar, i, true); err != nil {
+			return err
+		}
 	}
 
-	_, headStatusCode, _ := auth.GetRestAPI("HEAD", true, creds.URL+"/"+repoVar+"-cache/"+md.URL, creds.Username, creds.Apikey, "", nil, 1)
+	_, headStatusCode, headers := auth.GetRestAPI(ctx, "HEAD", true, creds.URL+"/"+repoVar+"-cache/"+md.URL, creds.Username, creds.Apikey, "", nil, 1)
+	if flags.MirrorVar {
+		if headStatusCode != 200 {
+			headers = nil
+		}
+		return mirror.Fetch(ctx, creds, creds.URL+"/"+repoVar+md.URL, mirror.Dest(flags, md.URL), auth.Checksum{}, headers)
+	}
 	if headStatusCode == 200 {
 		log.Debug("skipping, got 200 on HEAD request for ", creds.URL+"/"+repoVar+"-cache/"+md.URL)
-		return
+		stats.Cached()
+		return nil
 	}
 
 	log.Info("Downloading ", creds.URL+"/"+repoVar+md.URL)
-	auth.GetRestAPI("GET", true, creds.URL+"/"+repoVar+md.URL, creds.Username, creds.Apikey, configPath+pkgRepoDlFolder+"/"+md.File, nil, 1)
-	os.Remove(configPath + pkgRepoDlFolder + "/" + md.File)
+	_, _, err := auth.Download(ctx, true, creds.URL+"/"+repoVar+md.URL, creds.Username, creds.Apikey, dlPath, auth.Checksum{})
+	auth.RemoveDownload(dlPath)
+	return err
 }
@@ -0,0 +1,88 @@
+package guard
+
+import (
+	"context"
+	"fmt"
+	"go-pkgdl/helpers"
+	"go-pkgdl/metrics"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//DiskUsage of the filesystem holding a folder
+type DiskUsage struct {
+	UsedPercent float64
+	Free        uint64
+}
+
+//DiskLimits percentages of a local filesystem in use at which the disk guard warns, and pauses workers
+type DiskLimits struct {
+	Warning   float64
+	Threshold float64
+}
+
+//Check usage of the filesystem holding path against the limits, returning the disk check result and, if workers should pause, why
+func (l DiskLimits) Check(path string, usage DiskUsage) (string, string) {
+	switch {
+	case usage.UsedPercent >= l.Threshold:
+		return "threshold", fmt.Sprintf("local disk holding %s is %.2f%% used (%d bytes free), over the %.0f%% threshold", path, usage.UsedPercent, usage.Free, l.Threshold)
+	case usage.UsedPercent >= l.Warning:
+		return "warning", ""
+	}
+	return "ok", ""
+}
+
+//existingDir path, or its closest parent that exists, e.g. for a -out folder not created yet
+func existingDir(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+//WatchDisk check the local filesystems holding paths every interval until ctx is done, pausing gate while any is over the limits
+func WatchDisk(ctx context.Context, paths []string, limits DiskLimits, interval time.Duration, gate *Gate) {
+	//checks run often, so warnings and errors are logged when a folder's result changes rather than every time
+	last := make(map[string]string)
+	for {
+		var reasons []string
+		for _, path := range paths {
+			usage, err := diskUsage(existingDir(path))
+			if err != nil {
+				if last[path] != "error" {
+					log.Warn("Local disk check of ", path, " failed, proceed with caution: ", err)
+				}
+				metrics.DiskChecked(path, "error", 0)
+				last[path] = "error"
+				continue
+			}
+			result, reason := limits.Check(path, usage)
+			metrics.DiskChecked(path, result, usage.UsedPercent)
+			if result == "warning" && last[path] != "warning" {
+				log.Warn("Local disk holding ", path, " is over warning ", limits.Warning, "% usage (", usage.Free, " bytes free), proceed with caution")
+			}
+			last[path] = result
+			if reason != "" {
+				reasons = append(reasons, reason)
+			}
+		}
+		if len(reasons) > 0 {
+			gate.Pause("disk", strings.Join(reasons, "; "))
+		} else {
+			gate.Resume("disk")
+		}
+		if !helpers.SleepContext(ctx, interval) {
+			return
+		}
+	}
+}
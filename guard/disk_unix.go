@@ -0,0 +1,19 @@
+// +build !windows
+
+package guard
+
+import "syscall"
+
+func diskUsage(path string) (DiskUsage, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return DiskUsage{}, err
+	}
+	//blocks reserved for root count as used, they are not available to pkgdl either
+	total := uint64(fs.Blocks) * uint64(fs.Bsize)
+	free := uint64(fs.Bavail) * uint64(fs.Bsize)
+	if total == 0 {
+		return DiskUsage{Free: free}, nil
+	}
+	return DiskUsage{UsedPercent: float64(total-free) / float64(total) * 100, Free: free}, nil
+}
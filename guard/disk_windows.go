@@ -0,0 +1,7 @@
+package guard
+
+import "errors"
+
+func diskUsage(path string) (DiskUsage, error) {
+	return DiskUsage{}, errors.New("local disk checks are not supported on windows")
+}
@@ -0,0 +1,144 @@
+package guard
+
+import (
+	"context"
+	"fmt"
+	"go-pkgdl/auth"
+	"go-pkgdl/helpers"
+	"go-pkgdl/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Gate holds workers back while any guard has it paused
+type Gate struct {
+	mu      sync.Mutex
+	reasons map[string]string
+	since   time.Time
+	resumed chan struct{}
+}
+
+//NewGate an open gate
+func NewGate() *Gate {
+	return &Gate{reasons: make(map[string]string), resumed: make(chan struct{})}
+}
+
+//Pause close the gate on behalf of guard, until it calls Resume
+func (g *Gate) Pause(guard string, reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.reasons[guard]; !ok {
+		log.Warn("Pausing workers: ", reason)
+	}
+	if len(g.reasons) == 0 {
+		g.since = time.Now()
+		metrics.Paused(true)
+	}
+	g.reasons[guard] = reason
+}
+
+//Resume lift the pause of guard, the gate opens once no guard has it paused
+func (g *Gate) Resume(guard string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.reasons[guard]; !ok {
+		return
+	}
+	delete(g.reasons, guard)
+	if len(g.reasons) == 0 {
+		log.Info("Resuming workers after ", time.Since(g.since).Round(time.Second))
+		metrics.Paused(false)
+		close(g.resumed)
+		g.resumed = make(chan struct{})
+	}
+}
+
+//Paused why the gate is closed, and since when. Empty if it is open
+func (g *Gate) Paused() (string, time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var reasons []string
+	for _, reason := range g.reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, "; "), g.since
+}
+
+//Wait until the gate is open, false if ctx was cancelled first
+func (g *Gate) Wait(ctx context.Context) bool {
+	for {
+		g.mu.Lock()
+		open := len(g.reasons) == 0
+		resumed := g.resumed
+		g.mu.Unlock()
+		if open {
+			return true
+		}
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+//StorageLimits when the storage guard pauses workers
+type StorageLimits struct {
+	//Warning and Threshold percentages of the filestore in use
+	Warning   float64
+	Threshold float64
+	//Repo whose Quota, in bytes, is enforced. 0 for none
+	Repo  string
+	Quota int64
+}
+
+//Check storage against the limits, returning the storage check result and, if workers should pause, why
+func (l StorageLimits) Check(storage auth.Storage) (string, string) {
+	if l.Quota > 0 {
+		if used, ok := storage.RepoBytes[l.Repo]; ok && used >= l.Quota {
+			return "quota", fmt.Sprintf("%s uses %d bytes, over its quota of %d", l.Repo, used, l.Quota)
+		}
+	}
+	switch {
+	case storage.UsedPercent < 0:
+		return "ok", ""
+	case storage.UsedPercent >= l.Threshold:
+		return "threshold", fmt.Sprintf("storage is %.2f%% used (%s), over the %.0f%% threshold", storage.UsedPercent, storage.Used, l.Threshold)
+	case storage.UsedPercent >= l.Warning:
+		log.Warn("Summary reporting that disk is over warning ", l.Warning, "% usage, (", storage.Used, ") proceed with caution")
+		return "warning", ""
+	}
+	return "ok", ""
+}
+
+//WatchStorage check Artifactory's storage every interval until ctx is done, pausing gate while it is over the limits
+func WatchStorage(ctx context.Context, creds auth.Creds, limits StorageLimits, interval time.Duration, gate *Gate) {
+	for {
+		log.Debug("Running Storage summary check every ", interval)
+		storage, err := auth.GetStorage(ctx, creds)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			//can't tell, so leave the gate as it is
+			log.Warn("Storage check failed, proceed with caution: ", err)
+			metrics.StorageChecked("error", 0)
+		} else {
+			result, reason := limits.Check(storage)
+			metrics.StorageChecked(result, storage.UsedPercent)
+			if reason != "" {
+				gate.Pause("storage", reason)
+			} else {
+				gate.Resume("storage")
+			}
+		}
+		if !helpers.SleepContext(ctx, interval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package guard
+
+import (
+	"context"
+	"go-pkgdl/auth"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGateWaitsForEveryGuard(t *testing.T) {
+	gate := NewGate()
+	if !gate.Wait(context.Background()) {
+		t.Fatal("open gate should not block")
+	}
+	gate.Pause("storage", "full")
+	gate.Pause("disk", "full")
+	done := make(chan bool)
+	go func() { done <- gate.Wait(context.Background()) }()
+
+	gate.Resume("storage")
+	select {
+	case <-done:
+		t.Fatal("gate opened while disk still paused it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	gate.Resume("disk")
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("Wait reported cancellation")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("gate did not open once every guard resumed")
+	}
+
+	gate.Pause("storage", "full")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if gate.Wait(ctx) {
+		t.Error("Wait should give up once ctx is cancelled")
+	}
+}
+
+func TestStorageLimits(t *testing.T) {
+	limits := StorageLimits{Warning: 70, Threshold: 85, Repo: "npm-remote-cache", Quota: 100}
+	cases := []struct {
+		storage auth.Storage
+		result  string
+	}{
+		{auth.Storage{UsedPercent: 50, RepoBytes: map[string]int64{"npm-remote-cache": 99}}, "ok"},
+		{auth.Storage{UsedPercent: 75}, "warning"},
+		{auth.Storage{UsedPercent: 90}, "threshold"},
+		{auth.Storage{UsedPercent: -1, RepoBytes: map[string]int64{"npm-remote-cache": 100}}, "quota"},
+		{auth.Storage{UsedPercent: -1}, "ok"},
+	}
+	for _, c := range cases {
+		result, reason := limits.Check(c.storage)
+		if result != c.result {
+			t.Errorf("%+v: got %s, want %s", c.storage, result, c.result)
+		}
+		if (reason != "") != (c.result == "threshold" || c.result == "quota") {
+			t.Errorf("%+v: unexpected reason %q", c.storage, reason)
+		}
+	}
+}
+
+func TestDiskLimits(t *testing.T) {
+	limits := DiskLimits{Warning: 80, Threshold: 90}
+	for used, want := range map[float64]string{50: "ok", 85: "warning", 95: "threshold"} {
+		result, reason := limits.Check("/tmp", DiskUsage{UsedPercent: used})
+		if result != want || (reason != "") != (want == "threshold") {
+			t.Errorf("%v%%: got %s %q, want %s", used, result, reason, want)
+		}
+	}
+}
+
+func TestWatchDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gate := NewGate()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		//no filesystem is 0% used, so a threshold of 0 always pauses
+		WatchDisk(ctx, []string{filepath.Join(dir, "not", "created", "yet")}, DiskLimits{Warning: 0, Threshold: 0}, time.Hour, gate)
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for reason, _ := gate.Paused(); reason == ""; reason, _ = gate.Paused() {
+		if time.Now().After(deadline) {
+			t.Fatal("disk guard did not pause the gate")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,151 @@
+package helpers
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+//EnvPrefix of the environment variables overriding run file values, PKGDL_<FLAG NAME>
+const EnvPrefix = "PKGDL_"
+
+//commandFlags run a command rather than configure a run, so they are only taken from the command line
+var commandFlags = map[string]bool{
+	"v": true, "config": true, "printconfig": true, "reset": true, "values": true, "listprofiles": true,
+	"addprofile": true, "removeprofile": true, "protectkey": true, "encryptcredsfile": true,
+}
+
+//credentialEnv flags whose PKGDL_ variables auth.ResolveCreds already reads as a credential source
+var credentialEnv = map[string]bool{"url": true, "user": true, "apikey": true, "token": true}
+
+//secretFlags redacted by PrintConfig
+var secretFlags = map[string]bool{"apikey": true, "token": true, "refreshtoken": true, "uapikey": true}
+
+//configSources where each flag's value came from, set by ApplyConfig
+var configSources = make(map[string]string)
+
+//ReadConfigFile a YAML run file, mapping flag names to their values. Lists are joined with commas, as in -retrystatus
+func ReadConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	values := make(map[string]string)
+	for name, value := range raw {
+		switch v := value.(type) {
+		case nil:
+			values[name] = ""
+		case []interface{}:
+			var items []string
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		case map[interface{}]interface{}:
+			return nil, fmt.Errorf("%s: %s must be a value or a list, not a map", path, name)
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+//ApplyConfig fill in the flags of fs not given on the command line from their PKGDL_ variable, then from the
+//run file named by -config or PKGDL_CONFIG. Flags left alone keep their default
+func ApplyConfig(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	for name := range configSources {
+		delete(configSources, name)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		configSources[f.Name] = "flag"
+	})
+
+	if configSources["config"] == "" {
+		if path, ok := lookupEnv(EnvPrefix + "CONFIG"); ok && fs.Lookup("config") != nil {
+			fs.Set("config", path)
+			configSources["config"] = "env " + EnvPrefix + "CONFIG"
+		}
+	}
+	var file map[string]string
+	if config := fs.Lookup("config"); config != nil && config.Value.String() != "" {
+		var err error
+		if file, err = ReadConfigFile(config.Value.String()); err != nil {
+			return err
+		}
+	}
+	var names []string
+	for name := range file {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %s in the run file", name)
+		}
+		if commandFlags[name] {
+			return fmt.Errorf("%s is a command, it can't be set in the run file", name)
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || configSources[f.Name] != "" || commandFlags[f.Name] {
+			return
+		}
+		env := EnvPrefix + strings.ToUpper(f.Name)
+		if value, ok := lookupEnv(env); ok && !credentialEnv[f.Name] {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid %s: %v", env, setErr)
+			}
+			configSources[f.Name] = "env " + env
+			return
+		}
+		if value, ok := file[f.Name]; ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid %s in the run file: %v", f.Name, setErr)
+			}
+			configSources[f.Name] = "file"
+			return
+		}
+		configSources[f.Name] = "default"
+	})
+	return err
+}
+
+//PrintConfig write the effective configuration of fs as a run file, noting where each value came from. Secrets are redacted
+func PrintConfig(w io.Writer, fs *flag.FlagSet) error {
+	fmt.Fprintln(w, "# effective pkgdl configuration, each value followed by where it came from")
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || commandFlags[f.Name] {
+			return
+		}
+		var value interface{} = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			value = getter.Get()
+		}
+		if secretFlags[f.Name] && f.Value.String() != "" {
+			value = "********"
+		}
+		line, marshalErr := yaml.Marshal(map[string]interface{}{f.Name: value})
+		if marshalErr != nil {
+			err = marshalErr
+			return
+		}
+		source := configSources[f.Name]
+		if source == "" {
+			source = "default"
+		}
+		_, err = fmt.Fprintf(w, "%s # %s\n", strings.TrimSuffix(string(line), "\n"), source)
+	})
+	return err
+}
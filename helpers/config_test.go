@@ -0,0 +1,81 @@
+package helpers
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	file, err := ioutil.TempFile("", "run*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("repo: npm-file\nworkers: 10\nduthreshold: 90\nretrystatus: [429, 503]\napikey: secret\n")
+	file.Close()
+
+	fs := flag.NewFlagSet("pkgdl", flag.ContinueOnError)
+	fs.String("config", "", "")
+	repo := fs.String("repo", "", "")
+	workers := fs.Int("workers", 50, "")
+	threshold := fs.Float64("duthreshold", 85, "")
+	retryStatus := fs.String("retrystatus", "500", "")
+	grace := fs.Int("grace", 30, "")
+	fs.String("apikey", "", "")
+	if err := fs.Parse([]string{"-repo", "npm-flag"}); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"PKGDL_CONFIG": file.Name(), "PKGDL_REPO": "npm-env", "PKGDL_WORKERS": "20"}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	if err := ApplyConfig(fs, lookupEnv); err != nil {
+		t.Fatal(err)
+	}
+	if *repo != "npm-flag" || *workers != 20 || *threshold != 90 || *retryStatus != "429,503" || *grace != 30 {
+		t.Errorf("got repo %s, workers %d, duthreshold %v, retrystatus %s, grace %d", *repo, *workers, *threshold, *retryStatus, *grace)
+	}
+
+	var out bytes.Buffer
+	if err := PrintConfig(&out, fs); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"repo: npm-flag # flag", "workers: 20 # env PKGDL_WORKERS", "duthreshold: 90 # file", "grace: 30 # default", `apikey: '********' # file`} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "secret") || strings.Contains(out.String(), "config:") {
+		t.Errorf("printed a secret or a command flag:\n%s", out.String())
+	}
+}
+
+func TestApplyConfigInvalid(t *testing.T) {
+	fs := flag.NewFlagSet("pkgdl", flag.ContinueOnError)
+	fs.String("config", "", "")
+	fs.Int("workers", 50, "")
+	err := ApplyConfig(fs, func(name string) (string, bool) { return "many", name == "PKGDL_WORKERS" })
+	if err == nil || !strings.Contains(err.Error(), "PKGDL_WORKERS") {
+		t.Errorf("invalid environment value gave %v", err)
+	}
+
+	file, err := ioutil.TempFile("", "run*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("wokers: 10\n")
+	file.Close()
+
+	fs = flag.NewFlagSet("pkgdl", flag.ContinueOnError)
+	fs.String("config", file.Name(), "")
+	fs.Int("workers", 50, "")
+	if err := ApplyConfig(fs, func(string) (string, bool) { return "", false }); err == nil || !strings.Contains(err.Error(), "wokers") {
+		t.Errorf("misspelled setting gave %v", err)
+	}
+}
@@ -2,11 +2,15 @@ package helpers
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"go-pkgdl/logging"
 	"io"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,8 +24,8 @@ type TraceData struct {
 	Fn   string
 }
 
-//SetLogger sets logger settings
-func SetLogger(logLevelVar string) {
+//SetLogger sets logger settings, format is text or json
+func SetLogger(logLevelVar string, format string) {
 	level, err := log.ParseLevel(logLevelVar)
 	if err != nil {
 		level = log.InfoLevel
@@ -29,18 +33,28 @@ func SetLogger(logLevelVar string) {
 	log.SetLevel(level)
 
 	log.SetReportCaller(true)
-	customFormatter := new(log.TextFormatter)
-	customFormatter.TimestampFormat = "2006-01-02 15:04:05"
-	customFormatter.QuoteEmptyFields = true
-	customFormatter.FullTimestamp = true
-	customFormatter.CallerPrettyfier = func(f *runtime.Frame) (string, string) {
-		repopath := strings.Split(f.File, "/")
-		function := strings.Replace(f.Function, "go-pkgdl/", "", -1)
-		return fmt.Sprintf("%s\t", function), fmt.Sprintf(" %s:%d\t", repopath[len(repopath)-1], f.Line)
+	switch format {
+	case "json":
+		//one object per line for log pipelines, with the run's fields and a field per job detail
+		jsonFormatter := new(log.JSONFormatter)
+		jsonFormatter.TimestampFormat = time.RFC3339Nano
+		jsonFormatter.CallerPrettyfier = func(f *runtime.Frame) (string, string) {
+			return strings.Replace(f.Function, "go-pkgdl/", "", -1), fmt.Sprintf("%s:%d", filepath.Base(f.File), f.Line)
+		}
+		log.SetFormatter(logging.WithRunFields(jsonFormatter))
+	default:
+		customFormatter := new(log.TextFormatter)
+		customFormatter.TimestampFormat = "2006-01-02 15:04:05"
+		customFormatter.QuoteEmptyFields = true
+		customFormatter.FullTimestamp = true
+		customFormatter.CallerPrettyfier = func(f *runtime.Frame) (string, string) {
+			repopath := strings.Split(f.File, "/")
+			function := strings.Replace(f.Function, "go-pkgdl/", "", -1)
+			return fmt.Sprintf("%s\t", function), fmt.Sprintf(" %s:%d\t", repopath[len(repopath)-1], f.Line)
+		}
+		log.SetFormatter(customFormatter)
+		fmt.Println("Log level set at ", level)
 	}
-
-	log.SetFormatter(customFormatter)
-	fmt.Println("Log level set at ", level)
 }
 
 //Check logger for errors
@@ -70,6 +84,43 @@ func Trace() TraceData {
 	return trace
 }
 
+//SleepContext sleep for d, returns false if ctx was cancelled first
+func SleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+//sizeUnits multipliers of the units ParseSize accepts. Artifactory reports binary units with decimal names
+var sizeUnits = map[string]float64{
+	"": 1, "B": 1, "BYTES": 1,
+	"K": 1 << 10, "KB": 1 << 10, "KIB": 1 << 10,
+	"M": 1 << 20, "MB": 1 << 20, "MIB": 1 << 20,
+	"G": 1 << 30, "GB": 1 << 30, "GIB": 1 << 30,
+	"T": 1 << 40, "TB": 1 << 40, "TIB": 1 << 40,
+}
+
+//ParseSize a size such as "512", "1.5 GB" or "20GiB" in bytes
+func ParseSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	split := strings.IndexFunc(size, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	number, unit := size, ""
+	if split >= 0 {
+		number, unit = size[:split], strings.ToUpper(strings.TrimSpace(size[split:]))
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	multiplier, ok := sizeUnits[unit]
+	if err != nil || !ok {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(value * multiplier), nil
+}
+
 //PrintDownloadPercent self explanatory
 func PrintDownloadPercent(done chan int64, path string, total int64) {
 	var stop = false
@@ -104,10 +155,10 @@ func PrintDownloadPercent(done chan int64, path string, total int64) {
 
 //Flags struct
 type Flags struct {
-	WorkersVar, WorkerSleepVar, DuCheckVar, PkgLimitVar, SleepQueueMaxVar                                                                                           int
-	StorageWarningVar, StorageThresholdVar                                                                                                                          float64
-	UsernameVar, ApikeyVar, URLVar, RepoVar, LogLevelVar, CredsFileVar, UpstreamUsernameVar, UpstreamApikeyVar, ForceTypeVar, PypiRegistryURLVar, PypiRepoSuffixVar string
-	ResetVar, ValuesVar, RandomVar, NpmMetadataVar, NpmRegistryOldVar                                                                                               bool
+	WorkersVar, WorkerSleepVar, DuCheckVar, PkgLimitVar, SleepQueueMaxVar, GraceVar, SeenMaxVar, ConnsVar, UpstreamConnsVar, RetriesVar, RetryBackoffVar, RetryMaxWaitVar, EjectAfterVar, ConnectTimeoutVar, TLSTimeoutVar, HeaderTimeoutVar, IdleTimeoutVar, TimeoutVar, StallTimeoutVar, PauseMaxVar, LocalDuCheckVar, LogMaxSizeVar, LogKeepVar                                                                                                                              int
+	StorageWarningVar, StorageThresholdVar, RPSVar, UpstreamRPSVar, LocalDuWarnVar, LocalDuThresholdVar                                                                                                                                                                                                                                                                                                                                                                         float64
+	UsernameVar, ApikeyVar, URLVar, RepoVar, LogLevelVar, CredsFileVar, UpstreamUsernameVar, UpstreamApikeyVar, ForceTypeVar, PypiRegistryURLVar, PypiRepoSuffixVar, ReportDirVar, RetryStatusVar, OutVar, CACertVar, ClientCertVar, ClientKeyVar, TLSMinVar, ProxyVar, UpstreamProxyVar, NoProxyVar, TokenVar, RefreshTokenVar, APIKeyFileVar, CredHelperVar, ProfileVar, AddProfileVar, RemoveProfileVar, CredsStrategyVar, CacheQuotaVar, LogFormatVar, LogDirVar, ConfigVar string
+	ResetVar, ValuesVar, RandomVar, NpmMetadataVar, NpmRegistryOldVar, ResumeVar, SeenPersistVar, WarmOnlyVar, MirrorVar, HTTP2Var, InsecureVar, ListProfilesVar, ProtectKeyVar, EncryptCredsFileVar, PrintConfigVar                                                                                                                                                                                                                                                            bool
 }
 
 //LineCounter counts  how many lines are in a file
@@ -155,32 +206,87 @@ func GetPreString(flags Flags) string {
 	return ""
 }
 
-//SetFlags function
-func SetFlags() Flags {
+//SetFlags parse the flags, filling in those not given from PKGDL_ environment variables and the -config run file
+func SetFlags() (Flags, error) {
 	var flags Flags
+	flag.StringVar(&flags.ConfigVar, "config", "", "YAML run file of flag values. Flags and PKGDL_<FLAG> environment variables override it. Default PKGDL_CONFIG")
+	flag.BoolVar(&flags.PrintConfigVar, "printconfig", false, "Print the effective configuration, merged from flags, PKGDL_ variables and the run file, and exit")
 	flag.StringVar(&flags.LogLevelVar, "log", "INFO", "Order of Severity: TRACE, DEBUG, INFO, WARN, ERROR, FATAL, PANIC")
+	flag.StringVar(&flags.LogFormatVar, "logformat", "text", "Log format: text, or json with the run id, repo, type and job details as fields")
+	flag.StringVar(&flags.LogDirVar, "logdir", "", "Folder to also write each run's log to, as pkgdl-<run id>.log")
+	flag.IntVar(&flags.LogMaxSizeVar, "logmaxsize", 100, "Rotate the -logdir log file once it reaches this many MB, 0 never rotates")
+	flag.IntVar(&flags.LogKeepVar, "logkeep", 5, "Number of rotated -logdir log files kept per run")
 	flag.IntVar(&flags.WorkersVar, "workers", 50, "Number of workers")
 	flag.IntVar(&flags.PkgLimitVar, "pkglimit", 0, "Number of packages to download. Default unlimited")
-	flag.IntVar(&flags.SleepQueueMaxVar, "queuemax", 75, "Max queued size before sleeping")
-	flag.IntVar(&flags.WorkerSleepVar, "workersleep", 5, "Worker sleep period in seconds")
+	flag.IntVar(&flags.SleepQueueMaxVar, "queuemax", 75, "Max work queue size, crawlers wait for workers once it is full")
+	flag.IntVar(&flags.WorkerSleepVar, "workersleep", 5, "Work queue depth reporting period in seconds")
+	flag.IntVar(&flags.GraceVar, "grace", 30, "Seconds in flight jobs get to finish after SIGINT/SIGTERM before they are aborted")
+	flag.IntVar(&flags.RetriesVar, "retries", 5, "Max attempts for a request that gets no response or a retryable status code")
+	flag.IntVar(&flags.RetryBackoffVar, "retrybackoff", 1, "Seconds to wait before the first retry, doubling with every further one")
+	flag.IntVar(&flags.RetryMaxWaitVar, "retrymaxwait", 60, "Max seconds to wait between retries")
+	flag.IntVar(&flags.ConnectTimeoutVar, "connecttimeout", 10, "Seconds to wait for a connection to be established")
+	flag.IntVar(&flags.TLSTimeoutVar, "tlstimeout", 10, "Seconds to wait for a TLS handshake")
+	flag.IntVar(&flags.HeaderTimeoutVar, "headertimeout", 60, "Seconds to wait for response headers once a request is sent")
+	flag.IntVar(&flags.StallTimeoutVar, "stalltimeout", 60, "Seconds a download may go without receiving data before it is aborted. 0 to never abort")
+	flag.IntVar(&flags.TimeoutVar, "timeout", 0, "Max seconds for a request, including its download. 0 for unlimited")
+	flag.IntVar(&flags.IdleTimeoutVar, "idletimeout", 90, "Seconds an idle keep-alive connection is kept for reuse")
+	flag.BoolVar(&flags.HTTP2Var, "http2", true, "Negotiate HTTP/2 with hosts that support it")
+	flag.StringVar(&flags.CACertVar, "cacert", "", "PEM bundle of CA certificates trusted on top of the system's, for Artifactory and upstream hosts")
+	flag.StringVar(&flags.ClientCertVar, "cert", "", "PEM client certificate presented for mutual TLS. Needs -key")
+	flag.StringVar(&flags.ClientKeyVar, "key", "", "PEM private key of the -cert client certificate")
+	flag.StringVar(&flags.TLSMinVar, "tlsmin", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	flag.BoolVar(&flags.InsecureVar, "insecure", false, "Skip verifying server certificates. Only for test instances")
+	flag.StringVar(&flags.ProxyVar, "proxy", "", "http://, https:// or socks5:// proxy for Binary Manager requests, or direct for none. Default HTTP_PROXY/HTTPS_PROXY")
+	flag.StringVar(&flags.UpstreamProxyVar, "uproxy", "", "http://, https:// or socks5:// proxy for upstream requests, or direct for none. Default HTTP_PROXY/HTTPS_PROXY")
+	flag.StringVar(&flags.NoProxyVar, "noproxy", "", "Comma separated hosts, domains and CIDRs reached without a proxy. Default NO_PROXY")
+	flag.StringVar(&flags.RetryStatusVar, "retrystatus", "204,429,500,502,503,504", "Comma separated status codes that are retried")
 	flag.IntVar(&flags.DuCheckVar, "ducheck", 5, "Disk Usage check in minutes")
 	flag.Float64Var(&flags.StorageWarningVar, "duwarn", 70, "Set Disk usage warning in %")
-	flag.Float64Var(&flags.StorageThresholdVar, "duthreshold", 85, "Set Disk usage threshold in %")
+	flag.Float64Var(&flags.StorageThresholdVar, "duthreshold", 85, "Set Disk usage threshold in %, workers pause while it is exceeded")
+	flag.IntVar(&flags.LocalDuCheckVar, "localducheck", 10, "Local disk usage check of the download folders in seconds")
+	flag.Float64Var(&flags.LocalDuWarnVar, "localduwarn", 80, "Set local disk usage warning in %")
+	flag.Float64Var(&flags.LocalDuThresholdVar, "localduthreshold", 90, "Set local disk usage threshold in %, workers writing to disk pause while it is exceeded")
+	flag.StringVar(&flags.CacheQuotaVar, "cachequota", "", "Pause workers while the repo's -cache uses more than this, e.g. 50GB")
+	flag.IntVar(&flags.PauseMaxVar, "pausemax", 0, "Abort the run once workers have been paused this many minutes, 0 waits for space indefinitely")
 	flag.StringVar(&flags.UsernameVar, "user", "", "Username")
 	flag.StringVar(&flags.ApikeyVar, "apikey", "", "API key or password")
+	flag.StringVar(&flags.TokenVar, "token", "", "Access or reference token, sent as a bearer token instead of -user/-apikey")
+	flag.StringVar(&flags.RefreshTokenVar, "refreshtoken", "", "Refresh token used to renew the access token once it expires. Default the one in download.json")
+	flag.StringVar(&flags.APIKeyFileVar, "apikeyfile", "", "File holding the API key of -user, or an access token if there is no user, so it doesn't show up in ps")
+	flag.StringVar(&flags.CredHelperVar, "credhelper", "", "Command printing {\"url\", \"username\", \"apikey\", \"token\"} JSON credentials, run with PKGDL_URL set")
 	flag.StringVar(&flags.UpstreamUsernameVar, "uuser", "", "Upstream Username")
 	flag.StringVar(&flags.UpstreamApikeyVar, "uapikey", "", "Upstream API key or password")
 	flag.StringVar(&flags.URLVar, "url", "", "Binary Manager URL")
+	flag.Float64Var(&flags.RPSVar, "rps", 0, "Max requests per second against the Binary Manager. 0 for unlimited")
+	flag.IntVar(&flags.ConnsVar, "conns", 0, "Max concurrent connections to the Binary Manager. 0 for unlimited")
+	flag.Float64Var(&flags.UpstreamRPSVar, "urps", 0, "Max requests per second against each upstream host. 0 for unlimited")
+	flag.IntVar(&flags.UpstreamConnsVar, "uconns", 0, "Max concurrent connections to each upstream host. 0 for unlimited")
 	flag.StringVar(&flags.RepoVar, "repo", "", "Download Repository")
 	flag.StringVar(&flags.PypiRegistryURLVar, "pypiregistryurl", "", "")
 	flag.StringVar(&flags.PypiRepoSuffixVar, "pypireposuffix", "", "")
+	flag.StringVar(&flags.ReportDirVar, "reportdir", "", "Folder the end of run JSON, CSV and HTML reports are written to. Default ~/.lorenygo/pkgDownloader/reports")
 	flag.BoolVar(&flags.ResetVar, "reset", false, "Reset creds file")
-	flag.BoolVar(&flags.ValuesVar, "values", false, "Output values")
+	flag.BoolVar(&flags.ValuesVar, "values", false, "Output the values of every profile, secrets redacted")
+	flag.StringVar(&flags.ProfileVar, "profile", "default", "Named server profile to use. default is download.json")
+	flag.StringVar(&flags.AddProfileVar, "addprofile", "", "Prompt for the URL and credentials of a new named profile")
+	flag.StringVar(&flags.RemoveProfileVar, "removeprofile", "", "Remove a named profile")
+	flag.BoolVar(&flags.ProtectKeyVar, "protectkey", false, "Protect the master key with a passphrase, prompted for or taken from PKGDL_PASSPHRASE. An empty one removes the protection")
+	flag.BoolVar(&flags.EncryptCredsFileVar, "encryptcredsfile", false, "Encrypt the -credsfile in place with the master key")
+	flag.BoolVar(&flags.ListProfilesVar, "listprofiles", false, "List the profiles, marking the selected one")
 	flag.BoolVar(&flags.RandomVar, "random", false, "Attempt to pull packages in random queue order")
+	flag.IntVar(&flags.SeenMaxVar, "seenmax", 1000000, "Max number of packages remembered to suppress duplicates found by different searches. 0 for unlimited")
+	flag.BoolVar(&flags.SeenPersistVar, "seenpersist", false, "Keep the packages seen by a completed run, so later runs only queue new ones")
+	flag.BoolVar(&flags.ResumeVar, "resume", false, "Resume the previous run against the repository, skipping directories, search pages and packages its journal already has")
+	flag.BoolVar(&flags.WarmOnlyVar, "warmonly", false, "Stream downloads straight to discard instead of temp files, so no local disk space is used")
+	flag.BoolVar(&flags.MirrorVar, "mirror", false, "Keep downloaded artifacts in their repository layout under -out, skipping those already there with a matching checksum")
+	flag.StringVar(&flags.OutVar, "out", "", "Folder -mirror saves artifacts to, under the repository's name. Default a mirror folder next to download.json")
 	flag.BoolVar(&flags.NpmMetadataVar, "npmMD", false, "Only download NPM Metadata")
-	flag.StringVar(&flags.CredsFileVar, "credsfile", "", "File with creds. If there is more than one, it will pick randomly per request. Use whitespace to separate out user and password")
+	flag.StringVar(&flags.CredsFileVar, "credsfile", "", "File with creds, one user and password, or access token, per line. Each job picks one with -credsstrategy")
+	flag.StringVar(&flags.CredsStrategyVar, "credsstrategy", "random", "How jobs pick a -credsfile credential: random, roundrobin, or weighted by their weight=N")
+	flag.IntVar(&flags.EjectAfterVar, "ejectafter", 3, "Stop using a -credsfile credential after this many 401/403 responses in a row. 0 to never")
 	flag.StringVar(&flags.ForceTypeVar, "forcerepotype", "", "force repo type rather than get from repository")
 	flag.BoolVar(&flags.NpmRegistryOldVar, "npmold", false, "use file rather than API")
 	flag.Parse()
-	return flags
+	err := ApplyConfig(flag.CommandLine, os.LookupEnv)
+	return flags, err
 }
@@ -0,0 +1,251 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//operations recorded in the journal
+const (
+	opCursor  = "cursor"
+	opVisited = "visited"
+	opQueued  = "queued"
+	opDone    = "done"
+	opFailed  = "failed"
+)
+
+type entry struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Value string          `json:"value,omitempty"`
+	Item  json.RawMessage `json:"item,omitempty"`
+}
+
+//Journal append only, on disk record of crawl cursors, queued items and finished items for one repository.
+//Cursors and visited directories are recorded as soon as their items are queued, so it is the queued items
+//that a resumed run fetches again until they are done. A nil Journal is valid and records nothing
+type Journal struct {
+	mu      sync.Mutex
+	file    *os.File
+	enc     *json.Encoder
+	cursors map[string]string
+	visited map[string]bool
+	pending map[string]json.RawMessage
+	done    map[string]bool
+	failed  map[string]bool
+}
+
+//Open the journal for repo under dir. With resume the previous journal is replayed and appended to, otherwise it starts over
+func Open(dir string, repo string, resume bool) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		cursors: make(map[string]string),
+		visited: make(map[string]bool),
+		pending: make(map[string]json.RawMessage),
+		done:    make(map[string]bool),
+		failed:  make(map[string]bool),
+	}
+	path := filepath.Join(dir, repo+".journal")
+	mode := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		if err := j.replay(path); err != nil {
+			return nil, err
+		}
+		mode = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(path, mode, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if resume {
+		//start on a fresh line if the last run died mid write
+		if info, err := file.Stat(); err == nil && info.Size() > 0 && !endsWithNewline(path, info.Size()) {
+			file.Write([]byte("\n"))
+		}
+	}
+	j.file = file
+	j.enc = json.NewEncoder(file)
+	return j, nil
+}
+
+func endsWithNewline(path string, size int64) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return true
+	}
+	defer file.Close()
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, size-1); err != nil {
+		return true
+	}
+	return last[0] == '\n'
+}
+
+func (j *Journal) replay(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		log.Info("No journal found at ", path, ", starting from scratch")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var e entry
+		//a torn last line from a killed run is expected, skip anything unreadable
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Debug("skipping unreadable journal line ", line, ": ", err)
+			continue
+		}
+		j.apply(e)
+	}
+	log.Info("Resuming from journal ", path, ": ", len(j.done), " items done, ", len(j.pending), " unfinished of which ", len(j.failed), " failed, ", len(j.visited), " directories and ", len(j.cursors), " search cursors recorded")
+	return scanner.Err()
+}
+
+func (j *Journal) apply(e entry) {
+	switch e.Op {
+	case opCursor:
+		j.cursors[e.Key] = e.Value
+	case opVisited:
+		j.visited[e.Key] = true
+	case opQueued:
+		if !j.done[e.Key] {
+			j.pending[e.Key] = e.Item
+		}
+	case opDone:
+		j.done[e.Key] = true
+		delete(j.pending, e.Key)
+		delete(j.failed, e.Key)
+	case opFailed:
+		j.failed[e.Key] = true
+	}
+}
+
+func (j *Journal) record(e entry) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.apply(e)
+	if j.enc == nil {
+		return
+	}
+	if err := j.enc.Encode(e); err != nil {
+		log.Warn("Writing to the journal failed with error:", err)
+	}
+}
+
+//Cursor where the crawl for key got to
+func (j *Journal) Cursor(key string) (string, bool) {
+	if j == nil {
+		return "", false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	value, ok := j.cursors[key]
+	return value, ok
+}
+
+//SetCursor record how far the crawl for key got
+func (j *Journal) SetCursor(key string, value string) {
+	j.record(entry{Op: opCursor, Key: key, Value: value})
+}
+
+//Visited whether a directory URL was completely crawled
+func (j *Journal) Visited(url string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.visited[url]
+}
+
+//MarkVisited record that a directory URL, and everything under it, was crawled
+func (j *Journal) MarkVisited(url string) {
+	j.record(entry{Op: opVisited, Key: url})
+}
+
+//Done whether an item was already fetched successfully
+func (j *Journal) Done(key string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.done[key]
+}
+
+//Queued record an item handed to the workers, as JSON, so a resumed run queues it again until it is Finished without error
+func (j *Journal) Queued(key string, item interface{}) {
+	if j == nil {
+		return
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		log.Warn("Journaling ", key, " failed with error:", err)
+		return
+	}
+	j.mu.Lock()
+	_, pending := j.pending[key]
+	j.mu.Unlock()
+	if pending {
+		return
+	}
+	j.record(entry{Op: opQueued, Key: key, Item: data})
+}
+
+//Pending items queued by earlier runs that were never fetched, or failed, in key order
+func (j *Journal) Pending() []json.RawMessage {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	keys := make([]string, 0, len(j.pending))
+	for key := range j.pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	items := make([]json.RawMessage, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, j.pending[key])
+	}
+	return items
+}
+
+//Finished record the outcome of fetching an item. Failed items stay pending, so they are retried on resume
+func (j *Journal) Finished(key string, err error) {
+	if err != nil {
+		j.record(entry{Op: opFailed, Key: key})
+		return
+	}
+	j.record(entry{Op: opDone, Key: key})
+}
+
+//Close the journal file
+func (j *Journal) Close() error {
+	if j == nil || j.file == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc = nil
+	return j.file.Close()
+}
@@ -0,0 +1,125 @@
+package journal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := Open(dir, "npm-remote", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.SetCursor("search:ab", "251")
+	j.SetCursor("search:ab", "501")
+	j.MarkVisited("https://repo1.maven.org/maven2/junit/")
+	j.Finished("react", nil)
+	j.Finished("left-pad", errors.New("403"))
+	j.Close()
+
+	resumed, err := Open(dir, "npm-remote", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if cursor, ok := resumed.Cursor("search:ab"); !ok || cursor != "501" {
+		t.Errorf("expected last cursor 501, got %q (ok %v)", cursor, ok)
+	}
+	if !resumed.Visited("https://repo1.maven.org/maven2/junit/") {
+		t.Error("expected visited directory to be replayed")
+	}
+	if !resumed.Done("react") {
+		t.Error("expected finished item to be replayed as done")
+	}
+	if resumed.Done("left-pad") {
+		t.Error("failed items should be retried, not skipped")
+	}
+}
+
+func TestJournalStartOver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, _ := Open(dir, "gems-remote", false)
+	j.Finished("rails", nil)
+	j.Close()
+
+	//a torn line left by a killed run must not stop a resume
+	f, _ := os.OpenFile(filepath.Join(dir, "gems-remote.journal"), os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"op":"done","ke`)
+	f.Close()
+	resumed, err := Open(dir, "gems-remote", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed.Finished("rake", nil)
+	resumed.Close()
+	resumed, _ = Open(dir, "gems-remote", true)
+	if !resumed.Done("rails") || !resumed.Done("rake") {
+		t.Error("expected entries before and after the torn line to be replayed")
+	}
+	resumed.Close()
+
+	fresh, _ := Open(dir, "gems-remote", false)
+	defer fresh.Close()
+	if fresh.Done("rails") {
+		t.Error("expected journal to start over without resume")
+	}
+}
+
+func TestNilJournal(t *testing.T) {
+	var j *Journal
+	j.SetCursor("a", "b")
+	j.Finished("a", nil)
+	j.Queued("a", "a")
+	if j.Done("a") || j.Visited("a") || len(j.Pending()) != 0 {
+		t.Error("nil journal should record nothing")
+	}
+	if err := j.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJournalPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type item struct{ Name string }
+	j, _ := Open(dir, "pypi-remote", false)
+	for _, name := range []string{"requests", "flask", "django"} {
+		j.Queued(name, item{name})
+	}
+	j.Queued("flask", item{"flask"})
+	j.Finished("requests", nil)
+	j.Finished("flask", errors.New("500"))
+	j.Close()
+
+	resumed, err := Open(dir, "pypi-remote", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	pending := resumed.Pending()
+	if len(pending) != 2 || string(pending[0]) != `{"Name":"django"}` || string(pending[1]) != `{"Name":"flask"}` {
+		t.Errorf("expected the unfinished and failed items to be pending, got %s", pending)
+	}
+	resumed.Finished("django", nil)
+	if pending := resumed.Pending(); len(pending) != 1 {
+		t.Errorf("expected finished item to leave pending, got %s", pending)
+	}
+}
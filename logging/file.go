@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//File log file of one run, rotated once it grows past its maximum size. Older parts are kept as <name>.1 (the newest) up to <name>.<keep>
+type File struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+//OpenFile pkgdl-<runID>.log in dir, rotated every maxSize bytes, 0 for never, keeping keep older parts
+func OpenFile(dir string, runID string, maxSize int64, keep int) (*File, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f := &File{path: filepath.Join(dir, "pkgdl-"+runID+".log"), maxSize: maxSize, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+//Path of the file currently written to
+func (f *File) Path() string {
+	return f.path
+}
+
+func (f *File) open() error {
+	file, size, err := openAppend(f.path)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.size = size
+	return nil
+}
+
+func openAppend(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+//Write p, rotating first if it would take the file past its maximum size
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			//keep logging to the oversized file rather than lose entries, and say so once rather than on every write
+			fmt.Fprintln(os.Stderr, "Rotating", f.path, "failed, no longer rotating it:", err)
+			f.maxSize = 0
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+//rotate shift the older parts along and start a new file. The current file stays open until the new one is,
+//so a failed rotation leaves it to be written to
+func (f *File) rotate() error {
+	if f.keep < 1 {
+		os.Remove(f.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.keep))
+		for i := f.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		os.Rename(f.path, f.path+".1")
+	}
+	file, size, err := openAppend(f.path)
+	if err != nil {
+		return err
+	}
+	f.file.Close()
+	f.file = file
+	f.size = size
+	return nil
+}
+
+//Close the file
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
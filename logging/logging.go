@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Field names of pkgdl's structured logs
+const (
+	RunID    = "run_id"
+	Repo     = "repo"
+	Type     = "type"
+	Worker   = "worker"
+	Path     = "path"
+	Method   = "method"
+	URL      = "url"
+	Status   = "status"
+	Duration = "duration"
+)
+
+//run fields added to every entry formatted by a WithRunFields formatter
+var run = struct {
+	sync.RWMutex
+	fields log.Fields
+}{fields: make(log.Fields)}
+
+//NewRunID a sortable id telling runs apart, e.g. 20201018-150405-1a2b3c
+func NewRunID() string {
+	random := make([]byte, 3)
+	rand.Read(random)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(random)
+}
+
+//AddRunFields fields describing the whole run, such as its RunID, Repo and Type
+func AddRunFields(fields log.Fields) {
+	run.Lock()
+	defer run.Unlock()
+	for key, value := range fields {
+		run.fields[key] = value
+	}
+}
+
+type runFormatter struct {
+	log.Formatter
+}
+
+//WithRunFields formatter, with the run fields added to every entry
+func WithRunFields(formatter log.Formatter) log.Formatter {
+	return runFormatter{formatter}
+}
+
+//Format the entry with the run fields. Entries made by WithFields share their Data between goroutines, so it is copied rather than added to
+func (f runFormatter) Format(entry *log.Entry) ([]byte, error) {
+	run.RLock()
+	data := make(log.Fields, len(run.fields)+len(entry.Data))
+	for key, value := range run.fields {
+		data[key] = value
+	}
+	run.RUnlock()
+	for key, value := range entry.Data {
+		data[key] = value
+	}
+	withRun := *entry
+	withRun.Data = data
+	return f.Formatter.Format(&withRun)
+}
+
+type fieldsKey struct{}
+
+//WithFields a context whose FromContext logger adds fields, on top of those ctx already had, e.g. the Worker and Path of a job
+func WithFields(ctx context.Context, fields log.Fields) context.Context {
+	merged := make(log.Fields)
+	if parent, ok := ctx.Value(fieldsKey{}).(log.Fields); ok {
+		for key, value := range parent {
+			merged[key] = value
+		}
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+//FromContext logger with the fields of ctx
+func FromContext(ctx context.Context) *log.Entry {
+	fields, _ := ctx.Value(fieldsKey{}).(log.Fields)
+	return log.WithFields(fields)
+}
+
+//Seconds a duration as the Duration field logs it
+func Seconds(d time.Duration) float64 {
+	return d.Round(time.Millisecond).Seconds()
+}
@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestJobFields(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.StandardLogger()
+	defer func(out io.Writer, formatter log.Formatter) {
+		log.SetOutput(out)
+		log.SetFormatter(formatter)
+	}(logger.Out, logger.Formatter)
+	log.SetOutput(&out)
+	log.SetFormatter(WithRunFields(&log.JSONFormatter{}))
+	AddRunFields(log.Fields{RunID: "run", Repo: "npm-remote"})
+
+	ctx := WithFields(context.Background(), log.Fields{Worker: 3, Path: "lodash"})
+	ctx = WithFields(ctx, log.Fields{Path: "lodash/-/lodash-4.17.20.tgz"})
+	entry := FromContext(ctx)
+	entry.WithField(Status, 200).Info("Downloading")
+
+	var logged map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &logged); err != nil {
+		t.Fatal(err, out.String())
+	}
+	want := map[string]interface{}{RunID: "run", Repo: "npm-remote", Worker: 3.0, Path: "lodash/-/lodash-4.17.20.tgz", Status: 200.0, "msg": "Downloading"}
+	for key, value := range want {
+		if logged[key] != value {
+			t.Errorf("%s: got %v, want %v", key, logged[key], value)
+		}
+	}
+	if _, ok := entry.Data[RunID]; ok {
+		t.Error("run fields were added to the entry's own Data")
+	}
+}
+
+func TestFileRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := OpenFile(dir, "run", 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	want := map[string]string{"pkgdl-run.log": "fourth\n", "pkgdl-run.log.1": "third\n", "pkgdl-run.log.2": "second\n"}
+	for name, content := range want {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != content {
+			t.Errorf("%s: got %q, %v, want %q", name, data, err, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pkgdl-run.log.3")); !os.IsNotExist(err) {
+		t.Error("kept more rotated files than asked for")
+	}
+}
+
+func TestFileKeepsWritingWhenRotationFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := OpenFile(dir, "run", 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Path()
+	//nothing can be created here, so the new part can't be opened
+	f.path = filepath.Join(dir, "missing", "pkgdl-run.log")
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "first\nsecond\nthird\n" {
+		t.Errorf("expected every line in the current file, got %q, %v", data, err)
+	}
+}
@@ -1,11 +1,14 @@
 package maven
 
 import (
-	"container/list"
+	"context"
+	"encoding/json"
+	"go-pkgdl/auth"
 	"go-pkgdl/helpers"
-	"net/http"
+	"go-pkgdl/journal"
+	"go-pkgdl/pkgtype"
+	"io"
 	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -18,11 +21,51 @@ type Metadata struct {
 	File string
 }
 
+//Key repository path of the Maven artifact
+func (md Metadata) Key() string {
+	return md.URL
+}
+
+//Plugin maven package type
+type Plugin struct{}
+
+func init() {
+	pkgtype.Register("maven", Plugin{})
+}
+
+//Crawl walk the upstream directory listing for jars and poms
+func (Plugin) Crawl(ctx context.Context, env pkgtype.Env, sink pkgtype.Sink) {
+	GetMavenHrefs(ctx, env.URL, env.Base, sink, env.Flags, env.Journal)
+}
+
+//Decode a Metadata journaled by an earlier run
+func (Plugin) Decode(data []byte) (interface{}, error) {
+	var md Metadata
+	err := json.Unmarshal(data, &md)
+	return md, err
+}
+
+//Fetch download the jar or pom
+func (Plugin) Fetch(ctx context.Context, env pkgtype.Env, item interface{}, workerNum int) error {
+	md := item.(Metadata)
+	return pkgtype.StandardDownload(ctx, env, md.URL, md.File, auth.Checksum{})
+}
+
 //GetMavenHrefs parse hrefs for Maven files
-func GetMavenHrefs(url string, base string, MavenWorkerQueue *list.List, flags helpers.Flags) string {
-	resp, err := http.Get(url)
+func GetMavenHrefs(ctx context.Context, url string, base string, MavenWorkerQueue pkgtype.Sink, flags helpers.Flags, jrnl *journal.Journal) string {
+	if ctx.Err() != nil {
+		return ""
+	}
+	if jrnl.Visited(url) {
+		log.Debug("skipping ", url, ", already crawled")
+		return ""
+	}
+	resp, err := auth.Get(ctx, url)
 	// this needs to be threaded better..
 	helpers.Check(err, false, "HTTP GET error", helpers.Trace())
+	if err != nil {
+		return ""
+	}
 	defer resp.Body.Close()
 
 	log.Trace("trace resp", resp) //output from HTML download
@@ -35,6 +78,9 @@ func GetMavenHrefs(url string, base string, MavenWorkerQueue *list.List, flags h
 		switch {
 		case tt == html.ErrorToken:
 			// End of the document, we're done
+			if z.Err() == io.EOF && ctx.Err() == nil {
+				jrnl.MarkVisited(url)
+			}
 			return ""
 		case tt == html.StartTagToken:
 			t := z.Token()
@@ -47,7 +93,7 @@ func GetMavenHrefs(url string, base string, MavenWorkerQueue *list.List, flags h
 					if a.Key == "href" && (strings.HasSuffix(a.Val, "/")) {
 						strip := strings.TrimPrefix(a.Val, ":")
 						log.Debug("strip:", url+strip)
-						GetMavenHrefs(url+strip, base, MavenWorkerQueue, flags)
+						GetMavenHrefs(ctx, url+strip, base, MavenWorkerQueue, flags, jrnl)
 						break
 					}
 				}
@@ -57,7 +103,7 @@ func GetMavenHrefs(url string, base string, MavenWorkerQueue *list.List, flags h
 	}
 }
 
-func checkMaven(t html.Token, url string, base string, MavenWorkerQueue *list.List, flags helpers.Flags) {
+func checkMaven(t html.Token, url string, base string, MavenWorkerQueue pkgtype.Sink, flags helpers.Flags) {
 	//need to consider downloading pom.xml too
 	if strings.Contains(t.String(), ".jar") || strings.Contains(t.String(), ".pom") {
 		for _, a := range t.Attr {
@@ -66,17 +112,13 @@ func checkMaven(t html.Token, url string, base string, MavenWorkerQueue *list.Li
 				hrefraw := url + a.Val
 				href := strings.TrimPrefix(hrefraw, base)
 
-				if MavenWorkerQueue.Len() > flags.SleepQueueMaxVar {
-					log.Debug("Maven worker queue is at ", MavenWorkerQueue.Len(), ", sleeping for ", flags.WorkerSleepVar, " seconds...")
-					time.Sleep(time.Duration(flags.WorkerSleepVar) * time.Second)
-				}
 				log.Info("queuing download", href, a.Val, " queue length:", MavenWorkerQueue.Len())
 
 				//add Maven metadata to queue
 				var MavenMd Metadata
 				MavenMd.URL = strings.Replace(href, ":", "", -1)
 				MavenMd.File = strings.TrimPrefix(a.Val, ":")
-				MavenWorkerQueue.PushBack(MavenMd)
+				MavenWorkerQueue.Push(MavenMd)
 				break
 			}
 		}
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"go-pkgdl/stats"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "pkgdl"
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "HTTP requests made, by method and status code. Status 0 is a request that got no response.",
+	}, []string{"method", "status"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time until the response headers of an HTTP request arrived, by method.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"method"})
+	activeWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_workers",
+		Help:      "Workers currently fetching an item.",
+	})
+	crawling = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "crawler_running",
+		Help:      "1 while the crawler is still discovering packages.",
+	})
+	paused = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workers_paused",
+		Help:      "1 while a storage or disk space guard holds the workers back.",
+	})
+	storageUsed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "storage_used_percent",
+		Help:      "Artifactory storage usage reported by the last storage check.",
+	})
+	storageChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_checks_total",
+		Help:      "Storage checks run, by result: ok, warning, threshold, quota or error.",
+	}, []string{"result"})
+	diskUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "local_disk_used_percent",
+		Help:      "Usage of the local filesystem holding a download folder, by folder.",
+	}, []string{"path"})
+	diskChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "local_disk_checks_total",
+		Help:      "Local disk checks run, by result: ok, warning, threshold or error.",
+	}, []string{"result"})
+)
+
+//counterFunc expose a stats tally as a counter
+func counterFunc(name string, help string, value func(stats.Summary) int64) prometheus.Collector {
+	return prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: namespace, Name: name, Help: help}, func() float64 {
+		return float64(value(stats.Snapshot(0)))
+	})
+}
+
+//Register the run's metrics, labeled with the repository and package type, with the default registry
+func Register(repo string, pkgType string, queueDepth func() int) error {
+	registerer := prometheus.WrapRegistererWith(prometheus.Labels{"repo": repo, "type": pkgType}, prometheus.DefaultRegisterer)
+	collectors := []prometheus.Collector{
+		requests, requestDuration, activeWorkers, crawling, paused, storageUsed, storageChecks, diskUsed, diskChecks,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: namespace, Name: "queue_depth", Help: "Items waiting in the work queue."}, func() float64 {
+			return float64(queueDepth())
+		}),
+		counterFunc("items_discovered_total", "Items queued by the crawler.", func(s stats.Summary) int64 { return s.Discovered }),
+		counterFunc("items_duplicate_total", "Items suppressed because they were already queued.", func(s stats.Summary) int64 { return s.Duplicates }),
+		counterFunc("items_done_total", "Items fetched successfully.", func(s stats.Summary) int64 { return s.Done }),
+		counterFunc("items_failed_total", "Items that failed to fetch.", func(s stats.Summary) int64 { return s.Failed }),
+		counterFunc("retries_total", "Requests retried by the retry policy.", func(s stats.Summary) int64 { return s.Retries }),
+		counterFunc("checksum_failures_total", "Downloads that didn't match their checksum.", func(s stats.Summary) int64 { return s.ChecksumFailed }),
+		counterFunc("artifacts_downloaded_total", "Artifacts pulled through the remote.", func(s stats.Summary) int64 { return s.Downloaded }),
+		counterFunc("cache_hits_total", "Artifacts skipped because a HEAD on the remote's cache returned 200.", func(s stats.Summary) int64 { return s.Cached }),
+		counterFunc("downloaded_bytes_total", "Bytes received.", func(s stats.Summary) int64 { return s.Bytes }),
+	}
+	for _, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Handler serves the metrics of the default registry
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+//ObserveRequest count an HTTP request and how long it took
+func ObserveRequest(method string, statusCode int, took time.Duration) {
+	requests.WithLabelValues(method, strconv.Itoa(statusCode)).Inc()
+	requestDuration.WithLabelValues(method).Observe(took.Seconds())
+}
+
+//WorkerStarted a worker picked up an item
+func WorkerStarted() {
+	activeWorkers.Inc()
+}
+
+//WorkerFinished a worker is done with its item
+func WorkerFinished() {
+	activeWorkers.Dec()
+}
+
+//Crawling whether the crawler is still running
+func Crawling(running bool) {
+	if running {
+		crawling.Set(1)
+		return
+	}
+	crawling.Set(0)
+}
+
+//Paused whether the workers are held back by a guard
+func Paused(on bool) {
+	if on {
+		paused.Set(1)
+		return
+	}
+	paused.Set(0)
+}
+
+//StorageChecked record the result of a storage check, with the usage it reported, negative if unknown
+func StorageChecked(result string, usedPercent float64) {
+	storageChecks.WithLabelValues(result).Inc()
+	if result != "error" && usedPercent >= 0 {
+		storageUsed.Set(usedPercent)
+	}
+}
+
+//DiskChecked record the result of a local disk check of the filesystem holding path
+func DiskChecked(path string, result string, usedPercent float64) {
+	diskChecks.WithLabelValues(result).Inc()
+	if result != "error" {
+		diskUsed.WithLabelValues(path).Set(usedPercent)
+	}
+}
@@ -0,0 +1,68 @@
+package mirror
+
+import (
+	"context"
+	"go-pkgdl/auth"
+	"go-pkgdl/helpers"
+	"go-pkgdl/logging"
+	"go-pkgdl/stats"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//Dest where an artifact at repoPath is mirrored to, under -out and the repository's name
+func Dest(flags helpers.Flags, repoPath string) string {
+	//path.Clean of a rooted path can't climb out of the mirror with ..
+	clean := path.Clean("/" + repoPath)
+	return filepath.Join(flags.OutVar, flags.RepoVar, filepath.FromSlash(strings.TrimPrefix(clean, "/")))
+}
+
+//DefaultOut where -mirror saves artifacts without -out, a mirror folder next to download.json. Its download location
+//is download.json itself, older profiles have the folder holding it
+func DefaultOut(dlLocation string) string {
+	if dlLocation == "" {
+		return ""
+	}
+	if info, err := os.Stat(dlLocation); err == nil && info.IsDir() {
+		return filepath.Join(dlLocation, "mirror")
+	}
+	return filepath.Join(filepath.Dir(dlLocation), "mirror")
+}
+
+//Matches whether the file at dest has the expected checksum
+func Matches(dest string, expected auth.Checksum) bool {
+	file, err := os.Open(dest)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	return expected.Matches(file)
+}
+
+//Fetch mirror the artifact at url to dest, unless the cache has it and dest already matches its checksum.
+//cacheHeaders are the headers of a successful HEAD on the cache, nil if it doesn't have the artifact.
+//expected is the checksum upstream provided, if any, and is preferred over the one in cacheHeaders
+func Fetch(ctx context.Context, creds auth.Creds, url string, dest string, expected auth.Checksum, cacheHeaders http.Header) error {
+	if expected.Value == "" {
+		expected = auth.HeaderChecksum(cacheHeaders)
+	}
+	if cacheHeaders != nil && Matches(dest, expected) {
+		logging.FromContext(ctx).Debug("skipping, ", dest, " is already mirrored")
+		stats.Cached()
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	//download next to dest so a killed run never leaves a truncated artifact in the mirror
+	part := dest + ".part"
+	logging.FromContext(ctx).Info("Mirroring ", url, " to ", dest)
+	if _, _, err := auth.Download(ctx, true, url, creds.Username, creds.Apikey, part, expected); err != nil {
+		os.Remove(part)
+		return err
+	}
+	return os.Rename(part, dest)
+}
@@ -0,0 +1,103 @@
+package mirror
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"go-pkgdl/auth"
+	"go-pkgdl/helpers"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDest(t *testing.T) {
+	flags := helpers.Flags{OutVar: "/srv/mirror", RepoVar: "maven-remote"}
+	if dest := Dest(flags, "/com/foo/bar/1.0/bar-1.0.jar"); dest != "/srv/mirror/maven-remote/com/foo/bar/1.0/bar-1.0.jar" {
+		t.Errorf("unexpected destination %s", dest)
+	}
+	if dest := Dest(flags, "../../etc/passwd"); dest != "/srv/mirror/maven-remote/etc/passwd" {
+		t.Errorf("expected the path to stay inside the mirror, got %s", dest)
+	}
+}
+
+func TestDefaultOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//download.json's download location is the file itself
+	downloadJSON := filepath.Join(dir, "download.json")
+	if err := ioutil.WriteFile(downloadJSON, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out := DefaultOut(downloadJSON)
+	if out != filepath.Join(dir, "mirror") {
+		t.Errorf("expected a mirror folder next to download.json, got %s", out)
+	}
+	flags := helpers.Flags{OutVar: out, RepoVar: "maven-remote"}
+	if err := os.MkdirAll(filepath.Dir(Dest(flags, "com/foo/bar-1.0.jar")), 0755); err != nil {
+		t.Errorf("expected the default mirror to be creatable, got %v", err)
+	}
+	if out := DefaultOut(dir); out != filepath.Join(dir, "mirror") {
+		t.Errorf("expected a mirror folder in an older profile's download folder, got %s", out)
+	}
+}
+
+func TestFetchSkipsMatchingChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gets := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets++
+		w.Write([]byte("pool contents"))
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(dir, "pool", "main", "a.deb")
+	if err := Fetch(context.Background(), auth.Creds{}, server.URL, dest, auth.Checksum{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(dest); string(data) != "pool contents" {
+		t.Fatalf("expected artifact to be mirrored, got %q", data)
+	}
+	if _, err := os.Stat(dest + ".part"); !os.IsNotExist(err) {
+		t.Error("expected no .part file to be left behind")
+	}
+
+	sum := sha256.Sum256([]byte("pool contents"))
+	headers := http.Header{}
+	headers.Set("X-Checksum-Sha256", hex.EncodeToString(sum[:]))
+	if err := Fetch(context.Background(), auth.Creds{}, server.URL, dest, auth.Checksum{}, headers); err != nil || gets != 1 {
+		t.Errorf("expected a matching file to be skipped, got %d downloads (%v)", gets, err)
+	}
+	//a corrupted mirror copy no longer matches and is replaced
+	if err := ioutil.WriteFile(dest, []byte("truncated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Fetch(context.Background(), auth.Creds{}, server.URL, dest, auth.Checksum{}, headers); err != nil || gets != 2 {
+		t.Errorf("expected a mismatching file to be downloaded again, got %d downloads (%v)", gets, err)
+	}
+	if data, _ := ioutil.ReadFile(dest); string(data) != "pool contents" {
+		t.Errorf("expected the corrupted copy to be replaced, got %q", data)
+	}
+
+	//a download that doesn't match its checksum never lands in the mirror
+	os.Remove(dest)
+	headers.Set("X-Checksum-Sha256", "0000")
+	if err := Fetch(context.Background(), auth.Creds{}, server.URL, dest, auth.Checksum{}, headers); err == nil {
+		t.Error("expected a checksum mismatch")
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Error("expected the mismatching artifact to be removed")
+	}
+}
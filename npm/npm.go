@@ -1,16 +1,20 @@
 package npm
 
 import (
-	"container/list"
+	"context"
 	"encoding/json"
-	"fmt"
 	"go-pkgdl/auth"
 	"go-pkgdl/helpers"
+	"go-pkgdl/journal"
+	"go-pkgdl/logging"
+	"go-pkgdl/mirror"
+	"go-pkgdl/pkgtype"
+	"go-pkgdl/stats"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -24,6 +28,7 @@ type artifactMetadata struct {
 type distMetadata struct {
 	Dist struct {
 		Tarball string `json:"tarball"`
+		Shasum  string `json:"shasum"`
 	} `json:"dist"`
 }
 
@@ -36,40 +41,97 @@ type Metadata struct {
 	Package string
 }
 
+//Key package name, lowercased as the registry matches names regardless of case
+func (md Metadata) Key() string {
+	return strings.ToLower(md.Package)
+}
+
+//Plugin npm package type
+type Plugin struct{}
+
+func init() {
+	pkgtype.Register("npm", Plugin{})
+}
+
+//Crawl list packages through the search API, or the old _all_docs file
+func (Plugin) Crawl(ctx context.Context, env pkgtype.Env, sink pkgtype.Sink) {
+	if env.Flags.NpmRegistryOldVar {
+		log.Info("Using old method")
+		GetNPMList(ctx, env.ConfigPath, sink)
+	} else {
+		log.Info("Using search method")
+		GetNPMListNew(ctx, env.Creds, env.Flags, sink, env.URL, env.Journal)
+	}
+}
+
+//Decode a Metadata journaled by an earlier run
+func (Plugin) Decode(data []byte) (interface{}, error) {
+	var md Metadata
+	err := json.Unmarshal(data, &md)
+	return md, err
+}
+
+//Fetch download the package metadata and its tarballs
+func (Plugin) Fetch(ctx context.Context, env pkgtype.Env, item interface{}, workerNum int) error {
+	md := item.(Metadata)
+	return GetNPMMetadata(ctx, env.Creds, env.Creds.URL+"/api/npm/"+env.Flags.RepoVar+"/", md.ID, md.Package, env.ConfigPath, env.DlFolder, workerNum, env.Flags)
+}
+
 //GetNPMMetadata blah
-func GetNPMMetadata(creds auth.Creds, URL, packageIndex, packageName, configPath string, dlFolder string, workerNum int, flags helpers.Flags) {
-	data, _, _ := auth.GetRestAPI("GET", true, URL+packageName, creds.Username, creds.Apikey, "", nil, 1)
+func GetNPMMetadata(ctx context.Context, creds auth.Creds, URL, packageIndex, packageName, configPath string, dlFolder string, workerNum int, flags helpers.Flags) error {
+	logger := logging.FromContext(ctx)
+	data, statusCode, _ := auth.GetRestAPI(ctx, "GET", true, URL+packageName, creds.Username, creds.Apikey, "", nil, 1)
+	if err := auth.CheckStatus("GET", URL+packageName, statusCode); err != nil {
+		logger.Error(err)
+		return err
+	}
 	var metadata = artifactMetadata{}
 	err := json.Unmarshal([]byte(data), &metadata)
 	if err != nil {
-		log.Error("Worker ", workerNum, " error:"+err.Error())
+		logger.Error(err)
 	}
+	var tarballErr error
 	for i, j := range metadata.Versions {
 
 		s := strings.Split(j.Dist.Tarball, "api/npm/"+flags.RepoVar)
 		//fmt.Println(len(s), "length of s") //413 error
+		var cacheHeaders http.Header
 		if len(s) > 1 && s[1] != "" {
-			_, headStatusCode, _ := auth.GetRestAPI("HEAD", true, creds.URL+"/"+flags.RepoVar+"-cache/"+s[1], creds.Username, creds.Apikey, "", nil, 1)
-			if headStatusCode == 200 {
-				log.Debug("Worker ", workerNum, " skipping, got 200 on HEAD request for ", creds.URL+"/"+flags.RepoVar+"-cache/"+s[1])
+			_, headStatusCode, headers := auth.GetRestAPI(ctx, "HEAD", true, creds.URL+"/"+flags.RepoVar+"-cache/"+s[1], creds.Username, creds.Apikey, "", nil, 1)
+			if headStatusCode == 200 && flags.MirrorVar {
+				cacheHeaders = headers
+			} else if headStatusCode == 200 {
+				logger.Debug("Skipping, got 200 on HEAD request for ", creds.URL+"/"+flags.RepoVar+"-cache/"+s[1])
+				stats.Cached()
 				continue
 			}
 		}
-		if !flags.NpmMetadataVar {
-			packageDl := packageIndex + "-" + i + ".tgz"
-			log.Info("Worker ", workerNum, " Downloading ", s[1])
-			auth.GetRestAPI("GET", true, j.Dist.Tarball, creds.Username, creds.Apikey, configPath+dlFolder+"/"+packageDl, nil, 1)
-			err2 := os.Remove(configPath + dlFolder + "/" + packageDl)
+		expected := auth.Checksum{Algorithm: "sha1", Value: j.Dist.Shasum}
+		if !flags.NpmMetadataVar && flags.MirrorVar && len(s) > 1 {
+			if mirrorErr := mirror.Fetch(ctx, creds, j.Dist.Tarball, mirror.Dest(flags, s[1]), expected, cacheHeaders); mirrorErr != nil {
+				tarballErr = mirrorErr
+			}
+		} else if !flags.NpmMetadataVar {
+			dlPath := configPath + dlFolder + "/" + packageIndex + "-" + i + ".tgz"
+			if flags.WarmOnlyVar {
+				dlPath = auth.Discard
+			}
+			logger.WithField(logging.Path, s[1]).Info("Downloading ", s[1])
+			if _, _, dlErr := auth.Download(logging.WithFields(ctx, log.Fields{logging.Path: s[1]}), true, j.Dist.Tarball, creds.Username, creds.Apikey, dlPath, expected); dlErr != nil {
+				tarballErr = dlErr
+			}
+			err2 := auth.RemoveDownload(dlPath)
 			helpers.Check(err2, false, "Deleting file", helpers.Trace())
 		}
 	}
 	helpers.Check(err, false, "Reading", helpers.Trace())
 	if err != nil {
-		return
+		return err
 	}
+	return tarballErr
 }
 
-func GetNPMListNew(creds auth.Creds, flags helpers.Flags, npmWorkerQueue *list.List, url string) {
+func GetNPMListNew(ctx context.Context, creds auth.Creds, flags helpers.Flags, npmWorkerQueue pkgtype.Sink, url string, jrnl *journal.Journal) {
 	randomSearchMap := make(map[string]string)
 
 	//search for files via looping through permuations of two letters, alpabetised
@@ -79,7 +141,10 @@ func GetNPMListNew(creds auth.Creds, flags helpers.Flags, npmWorkerQueue *list.L
 			randomSearchMap[searchStr] = "taken"
 			if !flags.RandomVar {
 				log.Debug("Ordered search key:", searchStr)
-				npmSearch(creds, flags, npmWorkerQueue, url, searchStr)
+				if ctx.Err() != nil {
+					return
+				}
+				npmSearch(ctx, creds, flags, npmWorkerQueue, url, searchStr, jrnl)
 			}
 		}
 	}
@@ -88,7 +153,10 @@ func GetNPMListNew(creds auth.Creds, flags helpers.Flags, npmWorkerQueue *list.L
 	if flags.RandomVar {
 		for key, value := range randomSearchMap {
 			log.Debug("Random result search Key:", key, " Value:", value)
-			npmSearch(creds, flags, npmWorkerQueue, url, key)
+			if ctx.Err() != nil {
+				return
+			}
+			npmSearch(ctx, creds, flags, npmWorkerQueue, url, key, jrnl)
 		}
 	}
 }
@@ -105,19 +173,39 @@ type npmData struct {
 	Name string `json:"name"`
 }
 
-func npmSearch(creds auth.Creds, flags helpers.Flags, npmWorkerQueue *list.List, url string, searchStr string) {
+func npmSearch(ctx context.Context, creds auth.Creds, flags helpers.Flags, npmWorkerQueue pkgtype.Sink, url string, searchStr string, jrnl *journal.Journal) {
 	pg := 1
 	size := 250
 	counter := 0
-	for {
-		data, _, _ := auth.GetRestAPI("GET", false, url+"-/v1/search?text="+searchStr+"&from="+strconv.Itoa(pg)+"&size="+strconv.Itoa(size), "", "", "", nil, 0)
+	cursorKey := "search:" + searchStr
+	if cursor, ok := jrnl.Cursor(cursorKey); ok {
+		if cursor == "done" {
+			log.Debug("journal has search key ", searchStr, " as done, skipping")
+			return
+		}
+		if from, err := strconv.Atoi(cursor); err == nil {
+			log.Info("resuming search key ", searchStr, " from ", from)
+			pg = from
+		}
+	}
+	for ctx.Err() == nil {
+		data, statusCode, _ := auth.GetRestAPI(ctx, "GET", false, url+"-/v1/search?text="+searchStr+"&from="+strconv.Itoa(pg)+"&size="+strconv.Itoa(size), "", "", "", nil, 0)
+		if ctx.Err() != nil {
+			return
+		}
+		//the cursor stays put, so a resumed run searches this page again
+		if statusCode != http.StatusOK {
+			log.Warn("search key ", searchStr, " from ", pg, " received ", statusCode, ", moving on to next key")
+			return
+		}
 		var npmSearchApiData npmDataObj
-		err := json.Unmarshal(data, &npmSearchApiData)
-		if err != nil {
-			fmt.Println(err)
+		if err := json.Unmarshal(data, &npmSearchApiData); err != nil {
+			log.Warn("search key ", searchStr, " from ", pg, " returned an unreadable page, moving on to next key: ", err)
+			return
 		}
 		if len(npmSearchApiData.Data) == 0 {
 			log.Info("no more pages for ", searchStr, " moving on to next key")
+			jrnl.SetCursor(cursorKey, "done")
 			return
 		}
 		//log.Info("Found ", len(npmSearchApiData), " gems on page ", pg)
@@ -127,21 +215,18 @@ func npmSearch(creds auth.Creds, flags helpers.Flags, npmWorkerQueue *list.List,
 			npmMd.ID = strconv.Itoa(counter)
 			counter++
 			npmMd.Package = npmSearchApiData.Data[i].Package.Name
-			if npmWorkerQueue.Len() > flags.SleepQueueMaxVar {
-				log.Debug("NPM worker queue is at ", npmWorkerQueue.Len(), ", sleeping for ", flags.WorkerSleepVar, " seconds...")
-				time.Sleep(time.Duration(flags.WorkerSleepVar) * time.Second)
-			}
-			npmWorkerQueue.PushBack(npmMd)
+			npmWorkerQueue.Push(npmMd)
 		}
 		pg = pg + size
+		jrnl.SetCursor(cursorKey, strconv.Itoa(pg))
 	}
 }
 
 //GetNPMList function to convert raw list into readable text file
-func GetNPMList(configPath string, npmWorkQueue *list.List) {
+func GetNPMList(ctx context.Context, configPath string, npmWorkQueue pkgtype.Sink) {
 	if _, err := os.Stat(configPath + "all-npm.json"); os.IsNotExist(err) {
 		log.Info("No all-npm.json found, creating...")
-		auth.GetRestAPI("GET", false, "https://replicate.npmjs.com/_all_docs", "", "", configPath+"all-npm.json", nil, 1)
+		auth.GetRestAPI(ctx, "GET", false, "https://replicate.npmjs.com/_all_docs", "", "", configPath+"all-npm.json", nil, 1)
 	}
 	var result Metadata
 	file, err := os.Open(configPath + "all-npm.json")
@@ -153,6 +238,6 @@ func GetNPMList(configPath string, npmWorkQueue *list.List) {
 		result.ID = t
 		result.Package = j.ID
 		log.Debug("Get NPM list t:", result.ID, " ID:", result.Package)
-		npmWorkQueue.PushBack(result)
+		npmWorkQueue.Push(result)
 	}
 }
@@ -0,0 +1,180 @@
+package persona
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"go-pkgdl/auth"
+	"go-pkgdl/stats"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Strategies how Pool.Next picks the next credential
+var Strategies = []string{"random", "roundrobin", "weighted"}
+
+//Credential one line of a credsfile. Without a Username, Apikey is an access token
+type Credential struct {
+	//Label names the credential in logs and reports, without giving its secret away
+	Label    string
+	Username string
+	Apikey   string
+	Weight   int
+}
+
+//Parse a credsfile: one "user apikey [weight=N]" or "token [weight=N]" per line, separated by spaces or tabs.
+//Blank lines and lines starting with # are skipped
+func Parse(r io.Reader) ([]Credential, error) {
+	var creds []Credential
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		cred := Credential{Weight: 1}
+		if last := fields[len(fields)-1]; strings.HasPrefix(last, "weight=") {
+			weight, err := strconv.Atoi(strings.TrimPrefix(last, "weight="))
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("line %d: weight must be a number of at least 1", line)
+			}
+			cred.Weight = weight
+			fields = fields[:len(fields)-1]
+		}
+		switch len(fields) {
+		case 1:
+			cred.Apikey = fields[0]
+			cred.Label = "token@line" + strconv.Itoa(line)
+		case 2:
+			cred.Username, cred.Apikey = fields[0], fields[1]
+			cred.Label = cred.Username
+		default:
+			return nil, fmt.Errorf("line %d: expected a user and API key, or a token, optionally followed by weight=N", line)
+		}
+		creds = append(creds, cred)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("no credentials found")
+	}
+	//a user listed twice is told apart by its position in the file
+	seen := make(map[string]int)
+	for _, cred := range creds {
+		seen[cred.Label]++
+	}
+	for i := range creds {
+		if seen[creds[i].Label] > 1 {
+			creds[i].Label += "#" + strconv.Itoa(i+1)
+		}
+	}
+	return creds, nil
+}
+
+type entry struct {
+	Credential
+	//failures consecutive 401/403 responses
+	failures int
+	ejected  bool
+}
+
+//Pool hands out credentials per job, ejecting those that keep getting 401/403
+type Pool struct {
+	strategy   string
+	ejectAfter int
+
+	mu      sync.Mutex
+	entries []*entry
+	next    int
+	rand    *rand.Rand
+}
+
+//NewPool pick from creds with strategy. A credential getting ejectAfter 401/403 responses in a row is no longer used, 0 never ejects
+func NewPool(creds []Credential, strategy string, ejectAfter int) (*Pool, error) {
+	valid := false
+	for _, name := range Strategies {
+		valid = valid || name == strategy
+	}
+	if !valid {
+		return nil, fmt.Errorf("unknown strategy %q, expected one of %s", strategy, strings.Join(Strategies, ", "))
+	}
+	pool := &Pool{strategy: strategy, ejectAfter: ejectAfter, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for _, cred := range creds {
+		pool.entries = append(pool.entries, &entry{Credential: cred})
+	}
+	return pool, nil
+}
+
+//Next credential to use, false once every credential was ejected
+func (p *Pool) Next() (Credential, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var active []*entry
+	total := 0
+	for _, e := range p.entries {
+		if !e.ejected {
+			active = append(active, e)
+			total += e.Weight
+		}
+	}
+	if len(active) == 0 {
+		return Credential{}, false
+	}
+	switch p.strategy {
+	case "roundrobin":
+		e := active[p.next%len(active)]
+		p.next++
+		return e.Credential, true
+	case "weighted":
+		pick := p.rand.Intn(total)
+		for _, e := range active {
+			if pick < e.Weight {
+				return e.Credential, true
+			}
+			pick -= e.Weight
+		}
+	}
+	return active[p.rand.Intn(len(active))].Credential, true
+}
+
+//Observe a context whose authenticated requests are counted against cred, and may get it ejected
+func (p *Pool) Observe(ctx context.Context, cred Credential) context.Context {
+	return auth.WithObserver(ctx, func(statusCode int, err error) {
+		stats.CredentialUsed(cred.Label, statusCode, err)
+		p.report(cred.Label, statusCode)
+	})
+}
+
+func (p *Pool) report(label string, statusCode int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.entries {
+		if e.Label != label || e.ejected {
+			continue
+		}
+		if statusCode != http.StatusUnauthorized && statusCode != http.StatusForbidden {
+			//no response at all says nothing about the credential
+			if statusCode != 0 {
+				e.failures = 0
+			}
+			return
+		}
+		e.failures++
+		if p.ejectAfter > 0 && e.failures >= p.ejectAfter {
+			e.ejected = true
+			stats.CredentialEjected(label)
+			log.Error("Credential ", label, " got ", e.failures, " 401/403 responses in a row, no longer using it")
+		}
+		return
+	}
+}
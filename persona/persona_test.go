@@ -0,0 +1,62 @@
+package persona
+
+import (
+	"context"
+	"go-pkgdl/auth"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	creds, err := Parse(strings.NewReader("# ci users\nalice\tkey1\n\n  bob key2 weight=3\neyJtoken\nalice key3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 4 {
+		t.Fatalf("expected 4 credentials, got %+v", creds)
+	}
+	if creds[0].Username != "alice" || creds[0].Apikey != "key1" || creds[0].Label != "alice#1" {
+		t.Errorf("expected tab separated alice, got %+v", creds[0])
+	}
+	if creds[1].Weight != 3 || creds[1].Apikey != "key2" {
+		t.Errorf("expected bob with weight 3, got %+v", creds[1])
+	}
+	if creds[2].Username != "" || creds[2].Apikey != "eyJtoken" || creds[2].Label != "token@line5" {
+		t.Errorf("expected a token labeled by its line, got %+v", creds[2])
+	}
+	if _, err := Parse(strings.NewReader("a b c\n")); err == nil {
+		t.Error("expected a line with three fields to be rejected")
+	}
+}
+
+func TestRoundRobinAndEjection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, _, _ := r.BasicAuth(); user == "revoked" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	pool, err := NewPool([]Credential{{Label: "good", Username: "good", Apikey: "k", Weight: 1}, {Label: "revoked", Username: "revoked", Apikey: "k", Weight: 1}}, "roundrobin", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := map[string]int{}
+	for i := 0; i < 10; i++ {
+		cred, ok := pool.Next()
+		if !ok {
+			t.Fatal("expected a credential to be left")
+		}
+		used[cred.Label]++
+		auth.GetRestAPI(pool.Observe(context.Background(), cred), "GET", true, server.URL, cred.Username, cred.Apikey, "", nil, 1)
+	}
+	if used["revoked"] != 2 || used["good"] != 8 {
+		t.Errorf("expected revoked to be ejected after 2 401s, used %v", used)
+	}
+
+	if _, err := NewPool(nil, "fastest", 0); err == nil {
+		t.Error("expected an unknown strategy to be rejected")
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"go-pkgdl/auth"
+	"go-pkgdl/helpers"
 	"go-pkgdl/npm"
 	"log"
+	"net/http"
 	"os/user"
 	"testing"
 )
@@ -19,7 +22,7 @@ type Creds struct {
 
 func TestVerifyApiKey(t *testing.T) {
 	t.Log("Testing good credentials")
-	creds := userForTesting()
+	creds := userForTesting(t)
 	goodResult := auth.VerifyAPIKey(creds.URL, creds.Username, creds.Apikey)
 	if goodResult != true {
 		t.Errorf("error")
@@ -35,8 +38,9 @@ func TestVerifyApiKey(t *testing.T) {
 
 func TestGetNPMMetadata(t *testing.T) {
 	t.Log("Testing NPM Metadata")
-	creds := userForTesting()
-	npm.GetNPMMetadata(creds, creds.URL+"/api/npm/"+flags.RepoVar+"/", "49", "005-http-antao", creds.DlLocation, "")
+	creds := userForTesting(t)
+	flags := helpers.Flags{RepoVar: "npm-remote"}
+	npm.GetNPMMetadata(context.Background(), creds, creds.URL+"/api/npm/"+flags.RepoVar+"/", "49", "005-http-antao", creds.DlLocation, "", 0, flags)
 }
 
 func TestGenerateDownloadJSON(t *testing.T) {
@@ -52,11 +56,14 @@ func TestGenerateDownloadJSON(t *testing.T) {
 
 func TestCheckTypeAndRepoParams(t *testing.T) {
 	t.Log("Testing checkTypeAndRepoParams")
-	creds := userForTesting()
-	checkTypeAndRepoParams(creds, "blah")
+	creds := userForTesting(t)
+	if _, _, _, _, err := checkTypeAndRepoParams(context.Background(), creds, helpers.Flags{RepoVar: "blah"}); err == nil {
+		t.Errorf("expected an error for a repository that does not exist")
+	}
 }
 
-func userForTesting() auth.Creds {
+//userForTesting skips the calling test when there is no local Artifactory to test against
+func userForTesting(t *testing.T) auth.Creds {
 	usr, err := user.Current()
 	if err != nil {
 		log.Fatal(err)
@@ -68,5 +75,8 @@ func userForTesting() auth.Creds {
 		Apikey:     "password",
 		DlLocation: string(usr.HomeDir + "/testing"),
 	}
+	if _, err := http.Get(data.URL + "/api/system/ping"); err != nil {
+		t.Skip("no Artifactory reachable at ", data.URL, ": ", err)
+	}
 	return data
 }
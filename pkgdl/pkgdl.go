@@ -1,44 +1,98 @@
 package main
 
 import (
-	"bufio"
-	"container/list"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"go-pkgdl/auth"
-	"go-pkgdl/debian"
-	"go-pkgdl/docker"
-	"go-pkgdl/gems"
-	"go-pkgdl/generic"
+	"go-pkgdl/guard"
 	"go-pkgdl/helpers"
-	"go-pkgdl/maven"
-	"go-pkgdl/npm"
-	"go-pkgdl/pypi"
-	"go-pkgdl/rpm"
-	"math/rand"
+	"go-pkgdl/journal"
+	"go-pkgdl/logging"
+	"go-pkgdl/metrics"
+	"go-pkgdl/mirror"
+	"go-pkgdl/persona"
+	"go-pkgdl/pkgtype"
+	"go-pkgdl/queue"
+	"go-pkgdl/ratelimit"
+	"go-pkgdl/report"
+	"go-pkgdl/seen"
+	"go-pkgdl/stats"
+	"go-pkgdl/transport"
+	"io"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
 	"os/user"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+
+	//package types register themselves with pkgtype
+	_ "go-pkgdl/debian"
+	_ "go-pkgdl/docker"
+	_ "go-pkgdl/gems"
+	_ "go-pkgdl/generic"
+	_ "go-pkgdl/maven"
+	_ "go-pkgdl/npm"
+	_ "go-pkgdl/pypi"
+	_ "go-pkgdl/rpm"
 )
 
 var gitCommit string
 var version string
 
+//exit codes, so CI pipelines can act on the result of a run
+const (
+	exitSuccess = 0
+	exitError   = 1
+	exitPartial = 2
+	exitAborted = 3
+	exitAuth    = 4
+	//128 + SIGINT, as shells report it
+	exitInterrupted = 130
+)
+
+//abortWait how long aborted jobs get to clean up, e.g. remove partial downloads, before pkgdl exits without them
+const abortWait = 10 * time.Second
+
 func printVersion() {
 	fmt.Println("Current build version:", gitCommit, "Current Version:", version)
 }
 
 func main() {
 	versionFlag := flag.Bool("v", false, "Print the current version and exit")
-	flags := helpers.SetFlags()
-	helpers.SetLogger(flags.LogLevelVar)
+	flags, err := helpers.SetFlags()
+	if err != nil {
+		fmt.Println("Invalid configuration:", err)
+		os.Exit(exitError)
+	}
+	//before the logger is set up, so the output is a run file and nothing else
+	if flags.PrintConfigVar {
+		if err := helpers.PrintConfig(os.Stdout, flag.CommandLine); err != nil {
+			fmt.Println("Printing the configuration failed:", err)
+			os.Exit(exitError)
+		}
+		return
+	}
+	if flags.LogFormatVar != "text" && flags.LogFormatVar != "json" {
+		fmt.Println("Invalid -logformat", flags.LogFormatVar, ", expected text or json")
+		os.Exit(exitError)
+	}
+	helpers.SetLogger(flags.LogLevelVar, flags.LogFormatVar)
+	runID := logging.NewRunID()
+	logging.AddRunFields(log.Fields{logging.RunID: runID})
 
 	switch {
 	case *versionFlag:
@@ -46,7 +100,7 @@ func main() {
 		return
 	}
 
-	supportedTypes := [8]string{"debian", "docker", "generic", "maven", "npm", "pypi", "rpm", "gems"}
+	supportedTypes := pkgtype.Names()
 	usr, err := user.Current()
 	if err != nil {
 		log.Fatal(err)
@@ -54,6 +108,16 @@ func main() {
 	configFolder := "/.lorenygo/pkgDownloader/"
 	configPath := usr.HomeDir + configFolder
 
+	if flags.LogDirVar != "" {
+		logFile, err := logging.OpenFile(flags.LogDirVar, runID, int64(flags.LogMaxSizeVar)<<20, flags.LogKeepVar)
+		if err != nil {
+			log.Error("Could not open a log file in ", flags.LogDirVar, ": ", err)
+			os.Exit(exitError)
+		}
+		log.SetOutput(io.MultiWriter(os.Stderr, logFile))
+		log.Info("Logging run ", runID, " to ", logFile.Path())
+	}
+
 	log.Debug("Checking existence of download folders for:", supportedTypes)
 	for i := 0; i < len(supportedTypes); i++ {
 		if _, err := os.Stat(configPath + supportedTypes[i] + "Downloads/"); os.IsNotExist(err) {
@@ -66,72 +130,206 @@ func main() {
 	log.Debug("Done checking existence for:", supportedTypes)
 	//TODO clean up downloads dir beforehand
 
+	//set up before the first request, verifying the credentials may already need the CA bundle or client certificate
+	tlsConfig, err := transport.TLSConfig(flags.CACertVar, flags.ClientCertVar, flags.ClientKeyVar, flags.TLSMinVar, flags.InsecureVar)
+	if err != nil {
+		log.Error("Invalid TLS configuration: ", err)
+		os.Exit(exitError)
+	}
+	if flags.InsecureVar {
+		log.Warn("Server certificates are not verified, -insecure is set")
+	}
+	proxies, err := transport.NewProxies(flags.ProxyVar, flags.UpstreamProxyVar, flags.NoProxyVar)
+	if err != nil {
+		log.Error("Invalid proxy configuration: ", err)
+		os.Exit(exitError)
+	}
+	var cacheQuota int64
+	if flags.CacheQuotaVar != "" {
+		quota, err := helpers.ParseSize(flags.CacheQuotaVar)
+		if err != nil {
+			log.Error("Invalid -cachequota: ", err)
+			os.Exit(exitError)
+		}
+		cacheQuota = quota
+	}
+	shared := transport.New(transport.Options{
+		MaxConnsIdle:   flags.WorkersVar,
+		HTTP2:          flags.HTTP2Var,
+		ConnectTimeout: time.Duration(flags.ConnectTimeoutVar) * time.Second,
+		TLSTimeout:     time.Duration(flags.TLSTimeoutVar) * time.Second,
+		HeaderTimeout:  time.Duration(flags.HeaderTimeoutVar) * time.Second,
+		IdleTimeout:    time.Duration(flags.IdleTimeoutVar) * time.Second,
+		Timeout:        time.Duration(flags.TimeoutVar) * time.Second,
+		StallTimeout:   time.Duration(flags.StallTimeoutVar) * time.Second,
+		TLS:            tlsConfig,
+		Proxy:          proxies.Proxy,
+	})
+	auth.SetTransport(shared)
+
 	masterKey := auth.VerifyMasterKey(configPath + "master.key")
 
-	creds := auth.GetDownloadJSON(configPath+"download.json", masterKey)
+	if err := auth.ValidProfile(flags.ProfileVar); err != nil {
+		log.Error(err)
+		os.Exit(exitError)
+	}
+	profilePath := auth.ProfilePath(configPath, flags.ProfileVar)
+	switch {
+	case flags.ListProfilesVar:
+		listProfiles(configPath, flags.ProfileVar)
+		os.Exit(0)
+	case flags.AddProfileVar != "":
+		if _, err := auth.AddProfile(configPath, flags.AddProfileVar, masterKey); err != nil {
+			log.Error(err)
+			os.Exit(exitError)
+		}
+		log.Info("Added profile ", flags.AddProfileVar, ", use it with -profile ", flags.AddProfileVar)
+		os.Exit(0)
+	case flags.RemoveProfileVar != "":
+		if err := auth.RemoveProfile(configPath, flags.RemoveProfileVar); err != nil {
+			log.Error(err)
+			os.Exit(exitError)
+		}
+		log.Info("Removed profile ", flags.RemoveProfileVar)
+		os.Exit(0)
+	case flags.ValuesVar:
+		printProfiles(configPath, masterKey, flags.ProfileVar)
+		os.Exit(0)
+	case flags.ProtectKeyVar:
+		protectMasterKey(configPath+"master.key", masterKey)
+		os.Exit(0)
+	case flags.EncryptCredsFileVar:
+		if flags.CredsFileVar == "" {
+			log.Error("-encryptcredsfile encrypts the file given with -credsfile")
+			os.Exit(exitError)
+		}
+		if err := auth.EncryptCredsFile(flags.CredsFileVar, masterKey); err != nil {
+			log.Error(err)
+			os.Exit(exitError)
+		}
+		log.Info("Encrypted ", flags.CredsFileVar, " with the master key")
+		os.Exit(0)
+	}
 
-	if flags.UsernameVar == "" {
-		flags.UsernameVar = creds.Username
+	//credentials from the environment, -apikeyfile or -credhelper take precedence over the profile and never prompt,
+	//~/.netrc is only read when there is no profile
+	creds, credsErr := auth.ReadDownloadJSON(profilePath, masterKey)
+	credsURL := flags.URLVar
+	if credsURL == "" {
+		credsURL = creds.URL
 	}
-	if flags.ApikeyVar == "" {
-		flags.ApikeyVar = creds.Apikey
+	resolved, credsSource, err := auth.ResolveCreds(context.Background(), auth.CredSources{
+		URL:        credsURL,
+		HasProfile: credsErr == nil,
+		Username:   flags.UsernameVar,
+		APIKeyFile: flags.APIKeyFileVar,
+		Helper:     flags.CredHelperVar,
+	})
+	if err != nil {
+		log.Error("Resolving credentials failed: ", err)
+		os.Exit(exitAuth)
+	}
+	flagCreds := flags.URLVar != "" && (flags.ApikeyVar != "" || flags.TokenVar != "")
+	switch {
+	case credsSource != "":
+		log.Info("Using credentials from ", credsSource)
+		resolved.DlLocation = creds.DlLocation
+		creds = resolved
+	case credsErr == nil, flagCreds:
+	case flags.ProfileVar != auth.DefaultProfile:
+		log.Error("No profile ", flags.ProfileVar, ", add it with -addprofile ", flags.ProfileVar)
+		os.Exit(exitError)
+	case !terminal.IsTerminal(int(os.Stdin.Fd())):
+		log.Error("No credentials found and no terminal to prompt for them. Set PKGDL_URL with PKGDL_USER/PKGDL_APIKEY or PKGDL_TOKEN, add a ~/.netrc entry, or use -apikeyfile or -credhelper")
+		os.Exit(exitAuth)
+	default:
+		log.Error("error:", credsErr)
+		creds = auth.GenerateDownloadJSON(profilePath, false, masterKey)
+	}
+
+	if flags.TokenVar != "" {
+		//an access token replaces basic auth, it is sent as a bearer token
+		flags.UsernameVar = ""
+		flags.ApikeyVar = flags.TokenVar
+	} else {
+		if flags.UsernameVar == "" {
+			flags.UsernameVar = creds.Username
+		}
+		if flags.ApikeyVar == "" {
+			flags.ApikeyVar = creds.Apikey
+		}
 	}
 	if flags.URLVar == "" {
 		flags.URLVar = creds.URL
 	}
-	credsFilelength := 0
-	credsFileHash := make(map[int][]string)
+	var credsPool *persona.Pool
 	if flags.CredsFileVar != "" {
-		credsFile, err := os.Open(flags.CredsFileVar)
+		credsFile, err := auth.ReadCredsFile(flags.CredsFileVar, masterKey)
 		if err != nil {
 			log.Error("Invalid creds file:", err)
-			os.Exit(0)
+			os.Exit(exitError)
 		}
-		defer credsFile.Close()
-		scanner := bufio.NewScanner(credsFile)
-
-		for scanner.Scan() {
-			credsFileCreds := strings.Split(scanner.Text(), " ")
-			credsFileHash[credsFilelength] = credsFileCreds
-			credsFilelength = credsFilelength + 1
+		credsFileCreds, err := persona.Parse(bytes.NewReader(credsFile))
+		if err == nil {
+			credsPool, err = persona.NewPool(credsFileCreds, flags.CredsStrategyVar, flags.EjectAfterVar)
+		}
+		if err != nil {
+			log.Error("Invalid creds file: ", err)
+			os.Exit(exitError)
 		}
 
-		flags.UsernameVar = credsFileHash[0][0]
-		flags.ApikeyVar = credsFileHash[0][1]
-		log.Info("Number of creds in file:", credsFilelength)
-		log.Info("choose first one first:", flags.UsernameVar)
+		flags.UsernameVar = credsFileCreds[0].Username
+		flags.ApikeyVar = credsFileCreds[0].Apikey
+		log.Info("Number of creds in file:", len(credsFileCreds))
+		log.Info("choose first one first:", credsFileCreds[0].Label)
 	}
 	//os.Exit(0)
 
-	if (flags.RepoVar == "") && flags.ResetVar != true && flags.ValuesVar != true {
+	if (flags.RepoVar == "") && flags.ResetVar != true {
 		log.Error("Must specify -repo <Repository>")
 		flag.PrintDefaults()
-		os.Exit(0)
-	}
-	if flags.ValuesVar == true {
-		log.Info("User: ", creds.Username, "\nURL: ", creds.URL, "\nDownload location: ", creds.DlLocation)
-		os.Exit(0)
+		os.Exit(exitError)
 	}
-
 	if flags.ResetVar == true {
-		creds = auth.GenerateDownloadJSON(configPath+"download.json", true, masterKey)
+		creds = auth.GenerateDownloadJSON(profilePath, true, masterKey)
 		flags.UsernameVar = creds.Username
 		flags.ApikeyVar = creds.Apikey
 		flags.URLVar = creds.URL
 	}
 
+	if flags.UsernameVar == "" && flags.ApikeyVar != "" {
+		refreshToken := flags.RefreshTokenVar
+		var save func(access string, refresh string)
+		if flags.ApikeyVar == creds.Token {
+			//keep the profile current, the refresh token it has is spent once used
+			if refreshToken == "" {
+				refreshToken = creds.RefreshToken
+			}
+			save = func(access string, refresh string) {
+				err := auth.SaveDownloadJSONTokens(profilePath, masterKey, access, refresh)
+				helpers.Check(err, false, "Saving the refreshed access token", helpers.Trace())
+			}
+		}
+		if refreshToken != "" {
+			auth.SetRefreshToken(flags.URLVar, flags.ApikeyVar, refreshToken, save)
+		}
+	}
+
+	//requests to Artifactory go through -proxy, every other host through -uproxy
+	proxies.SetArtifactory(flags.URLVar)
 	if !auth.VerifyAPIKey(flags.URLVar, flags.UsernameVar, flags.ApikeyVar) {
-		if creds.Username == flags.UsernameVar && creds.Apikey == flags.ApikeyVar && creds.URL == flags.URLVar {
+		if credsSource == "" && creds.Username == flags.UsernameVar && creds.Apikey == flags.ApikeyVar && creds.URL == flags.URLVar {
 			log.Warn("Looks like there's an issue with your credentials file. Resetting")
-			auth.GenerateDownloadJSON(configPath+"download.json", true, masterKey)
-			creds = auth.GetDownloadJSON(configPath+"download.json", masterKey)
+			auth.GenerateDownloadJSON(profilePath, true, masterKey)
+			creds = auth.GetDownloadJSON(profilePath, masterKey)
 			flags.UsernameVar = creds.Username
 			flags.ApikeyVar = creds.Apikey
 			flags.URLVar = creds.URL
+			proxies.SetArtifactory(flags.URLVar)
 
 		} else {
 			log.Error("Looks like there's an issue with your custom credentials. Exiting")
-			os.Exit(1)
+			os.Exit(exitAuth)
 		}
 	}
 
@@ -140,11 +338,50 @@ func main() {
 	creds.Apikey = flags.ApikeyVar
 	creds.URL = flags.URLVar
 
-	var repotype, extractedURL, pypiRegistryURL, pypiRepoSuffix = checkTypeAndRepoParams(creds, flags)
-	pkgRepoDlFolder := repotype + "Downloads"
+	if flags.MirrorVar {
+		if flags.WarmOnlyVar {
+			log.Error("-mirror keeps artifacts on disk, it can't be combined with -warmonly")
+			os.Exit(exitError)
+		}
+		if flags.OutVar == "" {
+			flags.OutVar = mirror.DefaultOut(creds.DlLocation)
+		}
+		if flags.OutVar == "" {
+			log.Error("-mirror needs -out, or a download location in download.json")
+			os.Exit(exitError)
+		}
+		log.Info("Mirroring artifacts to ", flags.OutVar)
+	}
+
+	retryStatuses, err := parseStatusCodes(flags.RetryStatusVar)
+	if err != nil {
+		log.Error("Invalid -retrystatus: ", err)
+		os.Exit(exitError)
+	}
+	auth.SetRetryPolicy(auth.RetryPolicy{
+		MaxAttempts: flags.RetriesVar,
+		BaseDelay:   time.Duration(flags.RetryBackoffVar) * time.Second,
+		MaxDelay:    time.Duration(flags.RetryMaxWaitVar) * time.Second,
+		Statuses:    retryStatuses,
+	})
+
+	//throttle Artifactory and each upstream host separately
+	artifactoryURL, err := url.Parse(creds.URL)
+	if err != nil {
+		log.Error("Invalid URL ", creds.URL, ": ", err)
+		os.Exit(exitError)
+	}
+	auth.SetTransport(ratelimit.New(shared, artifactoryURL.Host,
+		ratelimit.Limits{RPS: flags.RPSVar, MaxConns: flags.ConnsVar},
+		ratelimit.Limits{RPS: flags.UpstreamRPSVar, MaxConns: flags.UpstreamConnsVar}))
+
+	repotype, extractedURL, pypiRegistryURL, pypiRepoSuffix, err := checkTypeAndRepoParams(context.Background(), creds, flags)
+	if err != nil {
+		log.Error(err)
+		os.Exit(exitError)
+	}
 
-	//case switch for different package types
-	workQueue := list.New()
+	workQueue := queue.New(flags.SleepQueueMaxVar)
 	var extractedURLStripped = strings.TrimSuffix(extractedURL, "/")
 	if !strings.HasSuffix(extractedURL, "/") {
 		extractedURL = extractedURL + "/"
@@ -152,215 +389,433 @@ func main() {
 	if flags.ForceTypeVar != "" {
 		repotype = flags.ForceTypeVar
 	}
-	switch repotype {
-	case "debian":
-		go func() {
-			debian.GetDebianHrefs(extractedURL+"pool/", extractedURLStripped, 1, "", workQueue)
-		}()
-
-	case "docker":
-		log.Warn("Work in progress, only works against Docker Hub")
-		go func() {
-			log.Info("testing if it goes in here multiple times case repotype") //it does not
-			docker.GetDockerImages(creds.URL, creds.Username, creds.Apikey, flags.RepoVar, extractedURL, extractedURLStripped, 1, "", workQueue, flags)
-		}()
-
-	case "generic":
-		log.Warn("Work in progress")
-		go func() {
-			log.Debug("Extraced URL:", extractedURL, " stripped:", extractedURLStripped)
-			//TODO: if url does not end in /, it messes up
-			generic.GetGenericHrefs(extractedURL, extractedURLStripped, workQueue, flags.RepoVar, flags)
-
-		}()
-
-	case "maven":
-		go func() {
-			maven.GetMavenHrefs(extractedURL, extractedURLStripped, workQueue, flags)
-		}()
-
-	case "npm":
-		if flags.NpmRegistryOldVar {
-			log.Info("Using old method")
-			npm.GetNPMList(configPath, workQueue)
-		} else {
-			log.Info("Using search method")
-			go func() {
-				npm.GetNPMListNew(creds, flags, workQueue, extractedURL)
-			}()
+	plugin, ok := pkgtype.Get(repotype)
+	if !ok {
+		log.Println("Unsupported package type", repotype, ". We currently support the following:", supportedTypes)
+		os.Exit(exitError)
+	}
+	stats.SetRun(flags.RepoVar, repotype)
+	logging.AddRunFields(log.Fields{logging.Repo: flags.RepoVar, logging.Type: repotype})
+	jrnl, err := journal.Open(configPath+"journal", flags.RepoVar, flags.ResumeVar)
+	if err != nil {
+		log.Error("Could not open the journal: ", err)
+		os.Exit(exitError)
+	}
+	seenSet := seen.New(flags.SeenMaxVar)
+	seenPath := configPath + "seen/" + flags.RepoVar + ".seen"
+	if flags.SeenPersistVar {
+		if err := seenSet.Load(seenPath); err != nil {
+			log.Warn("Could not load packages seen by earlier runs: ", err)
+		}
+		log.Info(seenSet.Len(), " packages seen by earlier runs will not be queued again")
+	}
+	env := pkgtype.Env{
+		Creds:           creds,
+		Flags:           flags,
+		ConfigPath:      configPath,
+		DlFolder:        repotype + "Downloads",
+		URL:             extractedURL,
+		Base:            extractedURLStripped,
+		PypiRegistryURL: pypiRegistryURL,
+		PypiRepoSuffix:  pypiRepoSuffix,
+		Journal:         jrnl,
+	}
+	//runCtx stops crawlers and idle workers, reqCtx aborts requests already in flight
+	runCtx, stopRun := context.WithCancel(context.Background())
+	reqCtx, abortRequests := context.WithCancel(context.Background())
+	hardStop := make(chan struct{})
+	workersDone := make(chan struct{})
+	var interrupted int32
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Warn("Received ", sig, ", no longer starting new jobs and giving in flight jobs ", flags.GraceVar, " seconds to finish. Send again to abort them now")
+		atomic.StoreInt32(&interrupted, 1)
+		stopRun()
+		workQueue.Close()
+		select {
+		case sig = <-signals:
+			log.Warn("Received ", sig, " again, aborting in flight jobs")
+		case <-time.After(time.Duration(flags.GraceVar) * time.Second):
+			log.Warn("Grace period is over, aborting in flight jobs")
+		}
+		abortRequests()
+		select {
+		case <-workersDone:
+		case <-time.After(abortWait):
+			close(hardStop)
 		}
+	}()
 
-	case "pypi":
-		go func() {
-			pypi.GetPypiHrefs(pypiRegistryURL+"/"+pypiRepoSuffix+"/", pypiRegistryURL, extractedURLStripped, flags, workQueue)
-		}()
+	if err := metrics.Register(flags.RepoVar, repotype, workQueue.Len); err != nil {
+		log.Warn("Could not register metrics: ", err)
+	}
+	//crawlCtx stops the crawler once -pkglimit jobs are queued, crawlers such as generic's local repo one never run out of items
+	crawlCtx, stopCrawl := context.WithCancel(runCtx)
+	sink := &discoverySink{queue: workQueue, journal: jrnl, seen: seenSet, limit: int64(flags.PkgLimitVar), stop: stopCrawl}
+	go func() {
+		metrics.Crawling(true)
+		sink.replayPending(crawlCtx, plugin)
+		plugin.Crawl(crawlCtx, env, sink)
+		metrics.Crawling(false)
+		log.Info(repotype, " discovery finished, draining ", workQueue.Len(), " queued jobs")
+		workQueue.Close()
+	}()
 
-	case "rpm":
-		go func() {
-			log.Info("rpm takes 10 seconds to init, please be patient")
-			//buggy. looks like there is a recursive search that screws it up
-			rpm.GetRpmHrefs(extractedURL, extractedURLStripped, workQueue, flags)
-		}()
-	case "gems":
+	//storage guard, pauses the workers while Artifactory is short on space
+	gate := guard.NewGate()
+	limits := guard.StorageLimits{Warning: flags.StorageWarningVar, Threshold: flags.StorageThresholdVar, Repo: flags.RepoVar + "-cache", Quota: cacheQuota}
+	go guard.WatchStorage(runCtx, creds, limits, time.Duration(flags.DuCheckVar)*time.Minute, gate)
+	//local disk guard, only workers writing downloads to disk need space
+	if writesToDisk(repotype, flags) {
+		paths := []string{configPath + env.DlFolder}
+		if flags.MirrorVar {
+			paths = append(paths, flags.OutVar)
+		}
+		diskLimits := guard.DiskLimits{Warning: flags.LocalDuWarnVar, Threshold: flags.LocalDuThresholdVar}
+		go guard.WatchDisk(runCtx, paths, diskLimits, time.Duration(flags.LocalDuCheckVar)*time.Second, gate)
+	}
+	var aborted, credsExhausted int32
+	if flags.PauseMaxVar > 0 {
+		pauseMax := time.Duration(flags.PauseMaxVar) * time.Minute
 		go func() {
-			log.Info("ruby takes 10 seconds to init, please be patient")
-			//buggy. looks like there is a recursive search that screws it up
-			gems.GetGemsHrefs(creds, extractedURL, extractedURLStripped, workQueue, flags)
+			for helpers.SleepContext(runCtx, 10*time.Second) {
+				if reason, since := gate.Paused(); reason != "" && time.Since(since) >= pauseMax {
+					log.Error("Workers paused for over ", pauseMax, ", aborting: ", reason)
+					atomic.StoreInt32(&aborted, 1)
+					stopRun()
+					workQueue.Close()
+					return
+				}
+			}
 		}()
-
-	default:
-		log.Println("Unsupported package type", repotype, ". We currently support the following:", supportedTypes)
-		os.Exit(0)
 	}
 
-	//disk usage check
-	go func() {
-		for {
-			log.Debug("Running Storage summary check every ", flags.DuCheckVar, " minutes")
-			auth.StorageCheck(creds, flags.StorageWarningVar, flags.StorageThresholdVar)
-			time.Sleep(time.Duration(flags.DuCheckVar) * time.Minute)
-		}
-	}()
-
 	//work queue
-	var ch = make(chan interface{}, flags.WorkersVar+1)
 	var wg sync.WaitGroup
-	workQueueCount := 0
 	for i := 0; i < flags.WorkersVar; i++ {
+		wg.Add(1)
 		go func(i int) {
+			defer wg.Done()
 			for {
-
-				s, ok := <-ch
+				if !gate.Wait(runCtx) {
+					return
+				}
+				s, ok := workQueue.Pop()
 				if !ok {
-					log.Info("Worker being returned to queue?", i)
-					wg.Done()
+					log.Debug("work queue closed, worker ", i, " exiting")
+					return
+				}
+				if atomic.LoadInt32(&aborted) == 1 || runCtx.Err() != nil {
+					return
 				}
 				log.Debug("worker ", i, " starting job")
-				if workQueueCount > flags.PkgLimitVar && flags.PkgLimitVar != 0 {
-					log.Info("Reached limit of ", flags.PkgLimitVar, " exiting now.")
-					os.Exit(0)
+
+				jobEnv := env
+				jobEnv.Creds = creds
+				jobCtx := reqCtx
+				if credsPool != nil {
+					//every job gets its own copy of the creds, workers never write to shared ones
+					cred, ok := credsPool.Next()
+					if !ok {
+						//the creds the run started with are among the ejected ones, so there is nothing left to fall back to
+						if atomic.CompareAndSwapInt32(&credsExhausted, 0, 1) {
+							log.Error("Every credential in ", flags.CredsFileVar, " was ejected, stopping the run")
+							stopRun()
+							workQueue.Close()
+						}
+						return
+					}
+					jobEnv.Creds.Username = cred.Username
+					jobEnv.Creds.Apikey = cred.Apikey
+					jobCtx = credsPool.Observe(reqCtx, cred)
+				}
+				jobCtx = logging.WithFields(jobCtx, log.Fields{logging.Worker: i, logging.Path: pkgtype.ItemKey(s)})
+				metrics.WorkerStarted()
+				started := time.Now()
+				err := plugin.Fetch(jobCtx, jobEnv, s, i)
+				metrics.WorkerFinished()
+				jobLog := logging.FromContext(jobCtx).WithField(logging.Duration, logging.Seconds(time.Since(started)))
+				if err != nil {
+					jobLog.WithError(err).Warn("Job failed")
 				} else {
-					workQueueCount++
+					jobLog.Debug("Job finished")
 				}
-
-				if flags.CredsFileVar != "" {
-					//pick random user and password from list
-					numCreds := len(credsFileHash)
-					rand.Seed(time.Now().UnixNano())
-					randCredIndex := rand.Intn(numCreds)
-					creds.Username = credsFileHash[randCredIndex][0]
-					creds.Apikey = credsFileHash[randCredIndex][1]
+				stats.Finished(err)
+				if reqCtx.Err() == nil {
+					jrnl.Finished(pkgtype.ItemKey(s), err)
 				}
-				switch repotype {
-
-				case "debian":
-					md := s.(debian.Metadata)
-					standardDownload(creds, md.URL, md.File, configPath, pkgRepoDlFolder, flags.RepoVar)
-					auth.GetRestAPI("PUT", true, creds.URL+"/api/storage/"+flags.RepoVar+"-cache"+md.URL+"?properties=deb.component="+md.Component+";deb.architecture="+md.Architecture+";deb.distribution="+md.Distribution, creds.Username, creds.Apikey, "", nil, 1)
-
-				case "docker":
-					md := s.(docker.Metadata)
-					docker.DlDockerLayers(creds, md, flags.RepoVar, i, false)
-
-				case "gems":
-					md := s.(gems.Metadata)
-					standardDownload(creds, md.URL, md.File, configPath, pkgRepoDlFolder, flags.RepoVar)
-
-				case "generic":
-					md := s.(generic.Metadata)
-					generic.GenericDownload(creds, md, configPath, pkgRepoDlFolder, flags.RepoVar, i)
-					//generic.CreateAndUploadFile(creds, md, flags, configPath, pkgRepoDlFolder, i)
-
-				case "maven":
-					md := s.(maven.Metadata)
-					standardDownload(creds, md.URL, md.File, configPath, pkgRepoDlFolder, flags.RepoVar)
-
-				case "npm":
-					md := s.(npm.Metadata)
-					npm.GetNPMMetadata(creds, creds.URL+"/api/npm/"+flags.RepoVar+"/", md.ID, md.Package, configPath, pkgRepoDlFolder, i, flags)
-
-				case "pypi":
-					md := s.(pypi.Metadata)
-					standardDownload(creds, md.URL, md.File, configPath, pkgRepoDlFolder, flags.RepoVar)
-
-				case "rpm":
-					md := s.(rpm.Metadata)
-					standardDownload(creds, md.URL, md.File, configPath, pkgRepoDlFolder, flags.RepoVar)
+				if err != nil {
+					seenSet.Forget(pkgtype.ItemKey(s))
 				}
-				log.Debug("worker ", i, " finished job")
 			}
 		}(i)
 
 	}
 
-	//debug port
+	//debug port, pprof and prometheus metrics
+	http.Handle("/metrics", metrics.Handler())
 	go func() {
 		http.ListenAndServe("0.0.0.0:8080", nil)
 	}()
-	for {
-		var count0 = 0
-		for workQueue.Len() == 0 {
-			log.Info(repotype, " work queue is empty, sleeping for ", flags.WorkerSleepVar, " seconds...")
-			time.Sleep(time.Duration(flags.WorkerSleepVar) * time.Second)
-			count0++
-			if count0 > 50 {
+
+	//report queue depth, and warn if the crawler stalls
+	go func() {
+		idle := 0
+		for helpers.SleepContext(runCtx, time.Duration(flags.WorkerSleepVar)*time.Second) {
+			depth := workQueue.Len()
+			log.Debug(repotype, " work queue depth ", depth, "/", workQueue.Cap())
+			if depth > 0 {
+				idle = 0
+				continue
+			}
+			idle++
+			if idle == 50 {
 				log.Warn("Looks like nothing's getting put into the workqueue. You might want to enable -debug and take a look")
 			}
-			if workQueue.Len() > 0 {
-				count0 = 0
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+	case <-hardStop:
+		log.Error("Workers did not stop after their jobs were aborted, exiting anyway")
+	}
+	jrnl.Close()
+	if flags.SeenPersistVar {
+		//packages still queued when a run stops early were never fetched, so only a completed run is kept
+		if atomic.LoadInt32(&aborted) == 1 || atomic.LoadInt32(&interrupted) == 1 || atomic.LoadInt32(&credsExhausted) == 1 {
+			log.Warn("Run did not complete, not saving the packages it has seen")
+		} else {
+			err := os.MkdirAll(configPath+"seen", 0700)
+			if err == nil {
+				err = seenSet.Save(seenPath)
 			}
+			helpers.Check(err, false, "Saving seen packages", helpers.Trace())
 		}
-		s := workQueue.Front().Value
-		workQueue.Remove(workQueue.Front())
-		ch <- s
 	}
-	close(ch)
-	wg.Wait()
-
-}
-
-func standardDownload(creds auth.Creds, dlURL string, file string, configPath string, pkgRepoDlFolder string, repoVar string) {
-	_, headStatusCode, _ := auth.GetRestAPI("HEAD", true, creds.URL+"/"+repoVar+"-cache/"+dlURL, creds.Username, creds.Apikey, "", nil, 1)
-	if headStatusCode == 200 {
-		log.Debug("skipping, got 200 on HEAD request for ", creds.URL+"/"+repoVar+"-cache/"+dlURL)
-		return
+	reportDir := flags.ReportDirVar
+	if reportDir == "" {
+		reportDir = configPath + "reports"
 	}
-
-	log.Info("Downloading ", creds.URL+"/"+repoVar+dlURL)
-	auth.GetRestAPI("GET", true, creds.URL+"/"+repoVar+dlURL, creds.Username, creds.Apikey, configPath+pkgRepoDlFolder+"/"+file, nil, 1)
-	os.Remove(configPath + pkgRepoDlFolder + "/" + file)
+	os.Exit(finish(reportDir, atomic.LoadInt32(&aborted) == 1, atomic.LoadInt32(&interrupted) == 1, atomic.LoadInt32(&credsExhausted) == 1))
 }
 
-//func standardUpload()
-
 //Test if remote repository exists and is a remote
-func checkTypeAndRepoParams(creds auth.Creds, flags helpers.Flags) (string, string, string, string) {
-	repoCheckData, repoStatusCode, _ := auth.GetRestAPI("GET", true, creds.URL+"/api/repositories/"+flags.RepoVar, creds.Username, creds.Apikey, "", nil, 1)
+func checkTypeAndRepoParams(ctx context.Context, creds auth.Creds, flags helpers.Flags) (string, string, string, string, error) {
+	repoCheckData, repoStatusCode, _ := auth.GetRestAPI(ctx, "GET", true, creds.URL+"/api/repositories/"+flags.RepoVar, creds.Username, creds.Apikey, "", nil, 1)
 	if repoStatusCode != 200 {
-		log.Error("Repo", flags.RepoVar, "does not exist.")
-		os.Exit(0)
+		return "", "", "", "", fmt.Errorf("repo %s does not exist", flags.RepoVar)
 	}
 	var result map[string]interface{}
 	json.Unmarshal([]byte(repoCheckData), &result)
 	//TODO: hard code for now, mass upload of files
 	if result["rclass"] == "local" && result["packageType"].(string) == "generic" {
-		return result["packageType"].(string), "", "", ""
+		return result["packageType"].(string), "", "", "", nil
 	} else if result["rclass"] != "remote" {
-		log.Error(flags.RepoVar, "is a", result["rclass"], "repository and not a remote repository.")
 		//maybe here.
-		os.Exit(0)
+		return "", "", "", "", fmt.Errorf("%s is a %v repository and not a remote repository", flags.RepoVar, result["rclass"])
 	}
 	if result["packageType"].(string) == "pypi" {
 		if result["pyPIRegistryUrl"] == nil || result["pyPIRepositorySuffix"] == nil {
 			log.Warn("pypi repo setting pyPIRegistryUrl/pyPIRepositorySuffix is nil, likely running older version.")
 			if flags.PypiRegistryURLVar == "" || flags.PypiRepoSuffixVar == "" {
-				log.Error("please manually set -pypiregistryurl and -pypireposuffix")
-				os.Exit(0)
-			} else {
-				return result["packageType"].(string), result["url"].(string), flags.PypiRegistryURLVar, flags.PypiRepoSuffixVar
+				return "", "", "", "", fmt.Errorf("please manually set -pypiregistryurl and -pypireposuffix")
 			}
+			return result["packageType"].(string), result["url"].(string), flags.PypiRegistryURLVar, flags.PypiRepoSuffixVar, nil
+		}
+		return result["packageType"].(string), result["url"].(string), result["pyPIRegistryUrl"].(string), result["pyPIRepositorySuffix"].(string), nil
+	}
+	return result["packageType"].(string), result["url"].(string), "", "", nil
+}
+
+//protectMasterKey prompt for a new passphrase and rewrite the master key encrypted with it, an empty one removes the protection
+func protectMasterKey(path string, masterKey string) {
+	passphrase, err := auth.ReadPassphrase("Enter a new master key passphrase, empty for none: ")
+	if err == nil && os.Getenv("PKGDL_PASSPHRASE") == "" && passphrase != "" {
+		var confirm string
+		confirm, err = auth.ReadPassphrase("Enter it again: ")
+		if err == nil && confirm != passphrase {
+			err = errors.New("the passphrases don't match")
+		}
+	}
+	if err == nil {
+		err = auth.ProtectMasterKey(path, masterKey, passphrase)
+	}
+	if err != nil {
+		log.Error("Protecting the master key failed: ", err)
+		os.Exit(exitError)
+	}
+	if passphrase == "" {
+		log.Info("The master key is no longer protected by a passphrase")
+	} else {
+		log.Info("The master key is protected by the passphrase, set PKGDL_PASSPHRASE for unattended runs")
+	}
+}
+
+//listProfiles print the profiles configured, marking the selected one
+func listProfiles(configPath string, selected string) {
+	names, err := auth.Profiles(configPath)
+	if err != nil {
+		log.Error("Listing profiles failed: ", err)
+		os.Exit(exitError)
+	}
+	for _, name := range names {
+		if name == selected {
+			fmt.Println("*", name)
+		} else {
+			fmt.Println(" ", name)
+		}
+	}
+}
+
+//printProfiles print the values of every profile, secrets redacted
+func printProfiles(configPath string, masterKey string, selected string) {
+	names, err := auth.Profiles(configPath)
+	if err != nil {
+		log.Error("Listing profiles failed: ", err)
+		os.Exit(exitError)
+	}
+	for _, name := range names {
+		creds, err := auth.ReadDownloadJSON(auth.ProfilePath(configPath, name), masterKey)
+		if err != nil {
+			log.Warn("Profile ", name, " can't be read: ", err)
+			continue
+		}
+		if name == selected {
+			name += " (selected)"
+		}
+		secret := "\nAPI key: " + auth.Redact(creds.Apikey)
+		if creds.Token != "" {
+			secret = "\nToken: " + auth.Redact(creds.Token) + "\nRefresh token: " + auth.Redact(creds.RefreshToken)
+		}
+		log.Info("Profile: ", name, "\nURL: ", creds.URL, "\nUser: ", creds.Username, secret, "\nDownload location: ", creds.DlLocation)
+	}
+}
+
+//parseStatusCodes comma separated list of HTTP status codes
+func parseStatusCodes(list string) (map[int]bool, error) {
+	codes := make(map[int]bool)
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		code, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
+
+//discoverySink counts what the crawler finds, skips what the journal has as done or was already queued, and closes the queue once -pkglimit is reached
+type discoverySink struct {
+	queue   *queue.Queue
+	journal *journal.Journal
+	seen    *seen.Set
+	limit   int64
+	count   int64
+	//stop the crawl, called once limit is reached
+	stop context.CancelFunc
+}
+
+func (d *discoverySink) Push(item interface{}) {
+	if d.journal.Done(pkgtype.ItemKey(item)) {
+		log.Debug("journal has ", pkgtype.ItemKey(item), " as done, skipping")
+		return
+	}
+	//reserve the key so a concurrent push of the same item is a duplicate, it is forgotten again unless the item is queued,
+	//so -seenpersist never saves items dropped by the limit or a closed queue
+	if !d.seen.Add(pkgtype.ItemKey(item)) {
+		log.Trace("already queued ", pkgtype.ItemKey(item), ", skipping")
+		stats.Duplicate()
+		return
+	}
+	//journaled before the limit and a closed queue can drop it, the crawler may already have moved its cursor past it
+	d.journal.Queued(pkgtype.ItemKey(item), item)
+	if d.limit != 0 {
+		count := atomic.AddInt64(&d.count, 1)
+		if count == d.limit+1 {
+			log.Info("Reached limit of ", d.limit, ", no longer queueing new jobs")
+			d.stop()
+			d.queue.Close()
+		}
+		if count > d.limit {
+			d.seen.Forget(pkgtype.ItemKey(item))
+			return
+		}
+	}
+	if !d.queue.Push(item) {
+		d.seen.Forget(pkgtype.ItemKey(item))
+		return
+	}
+	stats.Discovered()
+}
+
+func (d *discoverySink) Len() int {
+	return d.queue.Len()
+}
+
+//replayPending queue the items an interrupted run journaled but never fetched, or failed to fetch
+func (d *discoverySink) replayPending(ctx context.Context, decoder pkgtype.Decoder) {
+	pending := d.journal.Pending()
+	if len(pending) > 0 {
+		log.Info("Queueing ", len(pending), " items the previous run left unfinished")
+	}
+	for _, data := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+		item, err := decoder.Decode(data)
+		if err != nil {
+			log.Warn("Skipping unreadable journaled item: ", err)
+			continue
 		}
-		return result["packageType"].(string), result["url"].(string), result["pyPIRegistryUrl"].(string), result["pyPIRepositorySuffix"].(string)
+		//-seenpersist may have saved it while it was in flight
+		d.seen.Forget(pkgtype.ItemKey(item))
+		d.Push(item)
+	}
+}
+
+//writesToDisk whether jobs download to disk. Docker blobs, -npmMD metadata and -warmonly downloads are streamed to discard
+func writesToDisk(repotype string, flags helpers.Flags) bool {
+	switch {
+	case flags.WarmOnlyVar, repotype == "docker", repotype == "npm" && flags.NpmMetadataVar:
+		return false
+	}
+	return true
+}
+
+//finish log the final tally, write the run report and pick the exit code for it
+func finish(reportDir string, aborted bool, interrupted bool, credsExhausted bool) int {
+	summary := stats.Snapshot(report.TopFailing)
+	log.Info("Run finished in ", summary.Duration.Round(time.Second), ": ", summary.Discovered, " discovered, ", summary.Duplicates, " duplicates suppressed, ", summary.Done, " done, ", summary.Failed, " failed, ", summary.Downloaded, " artifacts downloaded, ", summary.Cached, " already cached")
+	paths, err := report.Write(reportDir, summary)
+	helpers.Check(err, false, "Writing the run report", helpers.Trace())
+	if err == nil {
+		log.Info("Run report written to ", strings.Join(paths, ", "))
+	}
+	switch {
+	case interrupted:
+		log.Warn("Run was interrupted before the work queue was drained")
+		return exitInterrupted
+	case credsExhausted:
+		log.Warn("Run stopped before the work queue was drained, every credential was ejected")
+		return exitAuth
+	case aborted:
+		log.Warn("Run was aborted before the work queue was drained")
+		return exitAborted
+	case summary.AuthFailed > 0 && summary.Done == 0:
+		return exitAuth
+	case summary.Failed > 0:
+		return exitPartial
 	}
-	return result["packageType"].(string), result["url"].(string), "", ""
+	return exitSuccess
 }
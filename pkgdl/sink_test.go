@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-pkgdl/journal"
+	"go-pkgdl/queue"
+	"go-pkgdl/seen"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type fakeItem struct {
+	Name string
+}
+
+func (i fakeItem) Key() string {
+	return i.Name
+}
+
+type fakeDecoder struct{}
+
+func (fakeDecoder) Decode(data []byte) (interface{}, error) {
+	var item fakeItem
+	err := json.Unmarshal(data, &item)
+	return item, err
+}
+
+func TestResumeRequeuesInterruptedWork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pkgdl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jrnl, err := journal.Open(dir, "fake-remote", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &discoverySink{queue: queue.New(10), journal: jrnl, seen: seen.New(0), stop: func() {}}
+	for i := 0; i < 8; i++ {
+		sink.Push(fakeItem{fmt.Sprintf("pkg%d", i)})
+	}
+	//pkg0 and pkg1 are fetched, pkg2 fails and pkg3 is in flight when the run is interrupted
+	for i := 0; i < 4; i++ {
+		item, _ := sink.queue.Pop()
+		switch i {
+		case 0, 1:
+			jrnl.Finished(item.(fakeItem).Key(), nil)
+		case 2:
+			jrnl.Finished(item.(fakeItem).Key(), errors.New("500"))
+		}
+	}
+	sink.queue.Close()
+	jrnl.Close()
+
+	jrnl, err = journal.Open(dir, "fake-remote", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jrnl.Close()
+	resumed := &discoverySink{queue: queue.New(10), journal: jrnl, seen: seen.New(0), stop: func() {}}
+	resumed.replayPending(context.Background(), fakeDecoder{})
+	//the crawler finding them again must not queue them twice
+	resumed.Push(fakeItem{"pkg4"})
+	resumed.Push(fakeItem{"pkg0"})
+	resumed.queue.Close()
+	var fetched []string
+	for {
+		item, ok := resumed.queue.Pop()
+		if !ok {
+			break
+		}
+		fetched = append(fetched, item.(fakeItem).Key())
+	}
+	sort.Strings(fetched)
+	expected := []string{"pkg2", "pkg3", "pkg4", "pkg5", "pkg6", "pkg7"}
+	if !reflect.DeepEqual(fetched, expected) {
+		t.Errorf("expected resume to fetch %v, got %v", expected, fetched)
+	}
+}
+
+func TestLimitLeavesDroppedItemsUnseen(t *testing.T) {
+	seenSet := seen.New(0)
+	sink := &discoverySink{queue: queue.New(10), seen: seenSet, limit: 2, stop: func() {}}
+	for i := 0; i < 4; i++ {
+		sink.Push(fakeItem{fmt.Sprintf("pkg%d", i)})
+	}
+	if seenSet.Len() != 2 {
+		t.Errorf("expected only the 2 queued items to be seen, got %d", seenSet.Len())
+	}
+	if !seenSet.Add("pkg3") {
+		t.Error("expected an item dropped by the limit to be queued by a later run")
+	}
+}
@@ -0,0 +1,139 @@
+package pkgtype
+
+import (
+	"context"
+	"fmt"
+	"go-pkgdl/auth"
+	"go-pkgdl/helpers"
+	"go-pkgdl/journal"
+	"go-pkgdl/logging"
+	"go-pkgdl/mirror"
+	"go-pkgdl/stats"
+	"sort"
+	"sync"
+)
+
+//Env run settings handed to every package type
+type Env struct {
+	Creds           auth.Creds
+	Flags           helpers.Flags
+	ConfigPath      string
+	DlFolder        string
+	URL             string
+	Base            string
+	PypiRegistryURL string
+	PypiRepoSuffix  string
+	Journal         *journal.Journal
+}
+
+//Keyer items that know their own identity, used to journal them across runs
+type Keyer interface {
+	Key() string
+}
+
+//ItemKey identity of an item, falling back to its printed value for items that aren't a Keyer
+func ItemKey(item interface{}) string {
+	if keyer, ok := item.(Keyer); ok {
+		return keyer.Key()
+	}
+	return fmt.Sprintf("%v", item)
+}
+
+//Sink receives items discovered by a crawler
+type Sink interface {
+	Push(item interface{})
+	Len() int
+}
+
+//Crawler discovers items to warm and pushes them into the sink
+type Crawler interface {
+	Crawl(ctx context.Context, env Env, sink Sink)
+}
+
+//Fetcher warms a single item previously discovered by the crawler, returning why it failed if it did
+type Fetcher interface {
+	Fetch(ctx context.Context, env Env, item interface{}, workerNum int) error
+}
+
+//Decoder turns an item journaled as JSON back into the item the crawler pushed, so a resumed run can queue it again
+type Decoder interface {
+	Decode(data []byte) (interface{}, error)
+}
+
+//Plugin a package type that can discover and warm items, and decode the ones it journaled
+type Plugin interface {
+	Crawler
+	Fetcher
+	Decoder
+}
+
+var (
+	pluginsMu sync.RWMutex
+	plugins   = make(map[string]Plugin)
+)
+
+//Register makes a package type available by name. Panics on duplicate names, like database/sql
+func Register(name string, plugin Plugin) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	if plugin == nil {
+		panic("pkgtype: Register plugin is nil")
+	}
+	if _, dup := plugins[name]; dup {
+		panic("pkgtype: Register called twice for package type " + name)
+	}
+	plugins[name] = plugin
+}
+
+//Get look up a registered package type
+func Get(name string) (Plugin, bool) {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	plugin, ok := plugins[name]
+	return plugin, ok
+}
+
+//Names sorted list of registered package types
+func Names() []string {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	var names []string
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//DownloadPath where workers download file to, auth.Discard when only warming the cache
+func (env Env) DownloadPath(file string) string {
+	if env.Flags.WarmOnlyVar {
+		return auth.Discard
+	}
+	return env.ConfigPath + env.DlFolder + "/" + file
+}
+
+//StandardDownload HEAD the cache, and pull the artifact through the remote if it isn't there yet, or mirror it with -mirror.
+//The download is verified against expected, or Artifactory's checksum when upstream doesn't provide one
+func StandardDownload(ctx context.Context, env Env, dlURL string, file string, expected auth.Checksum) error {
+	creds := env.Creds
+	repoVar := env.Flags.RepoVar
+	_, headStatusCode, headers := auth.GetRestAPI(ctx, "HEAD", true, creds.URL+"/"+repoVar+"-cache/"+dlURL, creds.Username, creds.Apikey, "", nil, 1)
+	if env.Flags.MirrorVar {
+		if headStatusCode != 200 {
+			headers = nil
+		}
+		return mirror.Fetch(ctx, creds, creds.URL+"/"+repoVar+dlURL, mirror.Dest(env.Flags, dlURL), expected, headers)
+	}
+	if headStatusCode == 200 {
+		logging.FromContext(ctx).Debug("skipping, got 200 on HEAD request for ", creds.URL+"/"+repoVar+"-cache/"+dlURL)
+		stats.Cached()
+		return nil
+	}
+
+	logging.FromContext(ctx).Info("Downloading ", creds.URL+"/"+repoVar+dlURL)
+	dlPath := env.DownloadPath(file)
+	_, _, err := auth.Download(ctx, true, creds.URL+"/"+repoVar+dlURL, creds.Username, creds.Apikey, dlPath, expected)
+	auth.RemoveDownload(dlPath)
+	return err
+}
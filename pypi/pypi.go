@@ -1,13 +1,16 @@
 package pypi
 
 import (
-	"container/list"
+	"context"
+	"encoding/json"
 	"fmt"
+	"go-pkgdl/auth"
 	"go-pkgdl/helpers"
-	"net/http"
+	"go-pkgdl/journal"
+	"go-pkgdl/pkgtype"
+	"io"
 	nurl "net/url"
 	"strings"
-	"time"
 
 	"github.com/prometheus/common/log"
 	"golang.org/x/net/html"
@@ -15,14 +18,55 @@ import (
 
 //Metadata struct of PyPi metadata object
 type Metadata struct {
-	URL  string
-	File string
+	URL    string
+	File   string
+	Sha256 string
+}
+
+//Key repository path of the PyPi artifact
+func (md Metadata) Key() string {
+	return md.URL
+}
+
+//Plugin pypi package type
+type Plugin struct{}
+
+func init() {
+	pkgtype.Register("pypi", Plugin{})
+}
+
+//Crawl walk the simple index of the registry
+func (Plugin) Crawl(ctx context.Context, env pkgtype.Env, sink pkgtype.Sink) {
+	GetPypiHrefs(ctx, env.PypiRegistryURL+"/"+env.PypiRepoSuffix+"/", env.PypiRegistryURL, env.Base, env.Flags, sink, env.Journal)
+}
+
+//Decode a Metadata journaled by an earlier run
+func (Plugin) Decode(data []byte) (interface{}, error) {
+	var md Metadata
+	err := json.Unmarshal(data, &md)
+	return md, err
+}
+
+//Fetch download the wheel or sdist
+func (Plugin) Fetch(ctx context.Context, env pkgtype.Env, item interface{}, workerNum int) error {
+	md := item.(Metadata)
+	return pkgtype.StandardDownload(ctx, env, md.URL, md.File, auth.Checksum{Algorithm: "sha256", Value: md.Sha256})
 }
 
 //GetPypiHrefs parse PyPi for debian files
-func GetPypiHrefs(registry string, registryBase string, url string, flags helpers.Flags, pypiWorkerQueue *list.List) string {
-	resp, err := http.Get(registry)
-	helpers.Check(err, true, "HTTP GET error", helpers.Trace())
+func GetPypiHrefs(ctx context.Context, registry string, registryBase string, url string, flags helpers.Flags, pypiWorkerQueue pkgtype.Sink, jrnl *journal.Journal) string {
+	if ctx.Err() != nil {
+		return ""
+	}
+	if jrnl.Visited(registry) {
+		log.Debug("skipping ", registry, ", already crawled")
+		return ""
+	}
+	resp, err := auth.Get(ctx, registry)
+	helpers.Check(err, false, "HTTP GET error", helpers.Trace())
+	if err != nil {
+		return ""
+	}
 	defer resp.Body.Close()
 
 	z := html.NewTokenizer(resp.Body)
@@ -32,6 +76,9 @@ func GetPypiHrefs(registry string, registryBase string, url string, flags helper
 		switch {
 		case tt == html.ErrorToken:
 			// End of the document, we're done
+			if z.Err() == io.EOF && ctx.Err() == nil {
+				jrnl.MarkVisited(registry)
+			}
 			return ""
 		case tt == html.StartTagToken:
 			t := z.Token()
@@ -42,7 +89,7 @@ func GetPypiHrefs(registry string, registryBase string, url string, flags helper
 				// recursive look
 				for _, a := range t.Attr {
 					if a.Key == "href" && (strings.HasSuffix(a.Val, "/")) {
-						GetPypiHrefs(registryBase+a.Val, registryBase, url, flags, pypiWorkerQueue)
+						GetPypiHrefs(ctx, registryBase+a.Val, registryBase, url, flags, pypiWorkerQueue, jrnl)
 						break
 					}
 				}
@@ -52,7 +99,7 @@ func GetPypiHrefs(registry string, registryBase string, url string, flags helper
 	}
 }
 
-func checkPypi(t html.Token, registry string, registryBase string, url string, flags helpers.Flags, pypiWorkerQueue *list.List) {
+func checkPypi(t html.Token, registry string, registryBase string, url string, flags helpers.Flags, pypiWorkerQueue pkgtype.Sink) {
 	if strings.Contains(t.String(), "#sha256") {
 		for _, a := range t.Attr {
 
@@ -70,18 +117,17 @@ func checkPypi(t html.Token, registry string, registryBase string, url string, f
 
 				file := strings.Split(parts[0], "/")
 
-				if pypiWorkerQueue.Len() > flags.SleepQueueMaxVar {
-					log.Debug("Pypi worker queue is at ", pypiWorkerQueue.Len(), ", sleeping for ", flags.WorkerSleepVar, " seconds...")
-					time.Sleep(time.Duration(flags.WorkerSleepVar) * time.Second)
-				}
-
 				fmt.Println("Queuing download", href, pypiWorkerQueue.Len())
 				//add pypi metadata to queue
 				var pypiMd Metadata
 				pypiMd.URL = href
 				//log.Info("href:", href)
 				pypiMd.File = file[len(file)-1]
-				pypiWorkerQueue.PushBack(pypiMd)
+				//links end in #sha256=<digest> of the file
+				if len(parts) > 1 {
+					pypiMd.Sha256 = strings.TrimPrefix(parts[1], "=")
+				}
+				pypiWorkerQueue.Push(pypiMd)
 				break
 			}
 		}
@@ -0,0 +1,78 @@
+package queue
+
+import (
+	"container/list"
+	"sync"
+)
+
+//Queue concurrency safe, bounded FIFO work queue. Push blocks while the queue is full, Pop blocks while it is empty
+type Queue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	items    *list.List
+	max      int
+	closed   bool
+}
+
+//New create a queue holding at most max items. max < 1 means a queue of one
+func New(max int) *Queue {
+	if max < 1 {
+		max = 1
+	}
+	q := &Queue{items: list.New(), max: max}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+//Push add an item, waiting for room if the queue is full. Items pushed after Close are dropped, returning false
+func (q *Queue) Push(item interface{}) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.items.Len() >= q.max && !q.closed {
+		q.notFull.Wait()
+	}
+	if q.closed {
+		return false
+	}
+	q.items.PushBack(item)
+	q.notEmpty.Signal()
+	return true
+}
+
+//Pop remove the oldest item, waiting for one to arrive. ok is false once the queue is closed and drained
+func (q *Queue) Pop() (item interface{}, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.items.Len() == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+	if q.items.Len() == 0 {
+		return nil, false
+	}
+	item = q.items.Remove(q.items.Front())
+	q.notFull.Signal()
+	return item, true
+}
+
+//Len current queue depth
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.items.Len()
+}
+
+//Cap maximum queue depth
+func (q *Queue) Cap() int {
+	return q.max
+}
+
+//Close stop accepting items and wake everyone waiting. Items already queued can still be popped
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
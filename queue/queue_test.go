@@ -0,0 +1,104 @@
+package queue
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueOrder(t *testing.T) {
+	q := New(3)
+	q.Push(1)
+	q.Push(2)
+	q.Push(3)
+	if q.Len() != 3 {
+		t.Fatalf("expected depth 3, got %d", q.Len())
+	}
+	for want := 1; want <= 3; want++ {
+		got, ok := q.Pop()
+		if !ok || got.(int) != want {
+			t.Errorf("expected %d, got %v (ok %v)", want, got, ok)
+		}
+	}
+}
+
+func TestQueuePushBlocksWhenFull(t *testing.T) {
+	q := New(1)
+	q.Push("a")
+	pushed := make(chan struct{})
+	go func() {
+		q.Push("b")
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push on a full queue did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if got, _ := q.Pop(); got != "a" {
+		t.Errorf("expected a, got %v", got)
+	}
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("blocked push was not woken by pop")
+	}
+}
+
+func TestQueueCloseDrains(t *testing.T) {
+	q := New(10)
+	q.Push("a")
+	q.Close()
+	if q.Push("dropped") {
+		t.Error("expected push after close to report the item as dropped")
+	}
+	if got, ok := q.Pop(); !ok || got != "a" {
+		t.Errorf("expected queued item after close, got %v (ok %v)", got, ok)
+	}
+	if _, ok := q.Pop(); ok {
+		t.Error("expected closed and drained queue to return ok false")
+	}
+}
+
+func TestQueueConcurrent(t *testing.T) {
+	const producers, perProducer, consumers = 4, 500, 8
+	q := New(16)
+
+	var produced sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		produced.Add(1)
+		go func() {
+			defer produced.Done()
+			for i := 0; i < perProducer; i++ {
+				q.Push(i)
+			}
+		}()
+	}
+
+	var mu sync.Mutex
+	count := 0
+	var consumed sync.WaitGroup
+	for c := 0; c < consumers; c++ {
+		consumed.Add(1)
+		go func() {
+			defer consumed.Done()
+			for {
+				if _, ok := q.Pop(); !ok {
+					return
+				}
+				mu.Lock()
+				count++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	produced.Wait()
+	q.Close()
+	consumed.Wait()
+	if count != producers*perProducer {
+		t.Errorf("expected %d items, got %d", producers*perProducer, count)
+	}
+}
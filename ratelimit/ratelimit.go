@@ -0,0 +1,217 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+//exhaustedBackoff how long a host is left alone once it reports no requests remaining but not when they reset
+const exhaustedBackoff = time.Minute
+
+//Limits requests per second and concurrent connections allowed against a host. 0 means unlimited
+type Limits struct {
+	RPS      float64
+	MaxConns int
+}
+
+//Transport http.RoundTripper limiting every host it talks to, honoring Retry-After and rate limit headers.
+//The Artifactory host gets its own limits, every other host is limited separately with the upstream limits
+type Transport struct {
+	Base            http.RoundTripper
+	artifactoryHost string
+	artifactory     Limits
+	upstream        Limits
+
+	mu    sync.Mutex
+	hosts map[string]*host
+}
+
+type host struct {
+	name    string
+	limiter *rate.Limiter
+	conns   chan struct{}
+
+	mu           sync.Mutex
+	blockedUntil time.Time
+}
+
+//New wrap base, limiting artifactoryHost with artifactory and every other host with upstream
+func New(base http.RoundTripper, artifactoryHost string, artifactory Limits, upstream Limits) *Transport {
+	return &Transport{
+		Base:            base,
+		artifactoryHost: artifactoryHost,
+		artifactory:     artifactory,
+		upstream:        upstream,
+		hosts:           make(map[string]*host),
+	}
+}
+
+func newHost(name string, limits Limits) *host {
+	h := &host{name: name, limiter: rate.NewLimiter(rate.Inf, 0)}
+	if limits.RPS > 0 {
+		h.limiter = rate.NewLimiter(rate.Limit(limits.RPS), int(math.Ceil(limits.RPS)))
+	}
+	if limits.MaxConns > 0 {
+		h.conns = make(chan struct{}, limits.MaxConns)
+	}
+	return h
+}
+
+func (t *Transport) host(name string) *host {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hosts[name]
+	if !ok {
+		limits := t.upstream
+		if name == t.artifactoryHost {
+			limits = t.artifactory
+		}
+		h = newHost(name, limits)
+		t.hosts[name] = h
+	}
+	return h
+}
+
+//RoundTrip wait for the host to allow another request, then make it
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := t.host(req.URL.Host)
+	ctx := req.Context()
+	if err := h.wait(ctx); err != nil {
+		return nil, err
+	}
+	if h.conns != nil {
+		select {
+		case h.conns <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		h.release()
+		return nil, err
+	}
+	h.observe(resp)
+	//the connection is busy until the body is done with
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: h.release}
+	return resp, nil
+}
+
+func (h *host) wait(ctx context.Context) error {
+	h.mu.Lock()
+	pause := time.Until(h.blockedUntil)
+	h.mu.Unlock()
+	if pause > 0 {
+		log.Debug("Waiting ", pause.Round(time.Second), " before the next request to ", h.name)
+		timer := time.NewTimer(pause)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	return h.limiter.Wait(ctx)
+}
+
+func (h *host) release() {
+	if h.conns != nil {
+		<-h.conns
+	}
+}
+
+//block stop requests to the host until
+func (h *host) block(until time.Time, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if until.After(h.blockedUntil) {
+		log.Warn(h.name, " ", reason, ", pausing requests to it for ", time.Until(until).Round(time.Second))
+		h.blockedUntil = until
+	}
+}
+
+//observe back off from the host when it says so
+func (h *host) observe(resp *http.Response) {
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if until, ok := RetryAfter(resp.Header); ok {
+			h.block(until, "sent Retry-After")
+			return
+		}
+	}
+	remaining, ok := remaining(resp.Header)
+	if !ok || remaining > 0 {
+		return
+	}
+	if until, ok := reset(resp.Header); ok {
+		h.block(until, "has no requests remaining")
+		return
+	}
+	h.block(time.Now().Add(exhaustedBackoff), "has no requests remaining")
+}
+
+//RetryAfter when the Retry-After header, in seconds or as an HTTP date, allows the next request
+func RetryAfter(header http.Header) (time.Time, bool) {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Now().Add(time.Duration(seconds) * time.Second), true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date, true
+	}
+	return time.Time{}, false
+}
+
+//remaining requests left in the window, from Docker Hub's "ratelimit-remaining: 76;w=21600" or the common X-RateLimit-Remaining
+func remaining(header http.Header) (int, bool) {
+	for _, name := range []string{"RateLimit-Remaining", "X-RateLimit-Remaining"} {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(value, ";", 2)[0]))
+		if err == nil {
+			return count, true
+		}
+	}
+	return 0, false
+}
+
+//reset when the rate limit window resets, as seconds from now or a unix timestamp
+func reset(header http.Header) (time.Time, bool) {
+	for _, name := range []string{"RateLimit-Reset", "X-RateLimit-Reset"} {
+		value, err := strconv.ParseInt(strings.TrimSpace(header.Get(name)), 10, 64)
+		if err != nil {
+			continue
+		}
+		//anything bigger than a day is a timestamp rather than a delay
+		if value > 24*60*60 {
+			return time.Unix(value, 0), true
+		}
+		return time.Now().Add(time.Duration(value) * time.Second), true
+	}
+	return time.Time{}, false
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
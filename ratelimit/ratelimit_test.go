@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryAfterBlocksHost(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: New(http.DefaultTransport, "", Limits{}, Limits{})}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	start := time.Now()
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if waited := time.Since(start); waited < 900*time.Millisecond {
+		t.Errorf("expected the second request to wait for Retry-After, waited %v", waited)
+	}
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	var active, peak int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := atomic.AddInt32(&active, 1)
+		for {
+			old := atomic.LoadInt32(&peak)
+			if now <= old || atomic.CompareAndSwapInt32(&peak, old, now) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	client := &http.Client{Transport: New(http.DefaultTransport, serverURL.Host, Limits{MaxConns: 2}, Limits{})}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if peak > 2 {
+		t.Errorf("expected at most 2 concurrent requests, saw %d", peak)
+	}
+}
+
+func TestRemaining(t *testing.T) {
+	header := http.Header{}
+	header.Set("ratelimit-remaining", "0;w=21600")
+	if count, ok := remaining(header); !ok || count != 0 {
+		t.Errorf("expected Docker Hub style header to parse as 0, got %d (ok %v)", count, ok)
+	}
+	header = http.Header{}
+	header.Set("X-RateLimit-Remaining", "42")
+	if count, ok := remaining(header); !ok || count != 42 {
+		t.Errorf("expected 42, got %d (ok %v)", count, ok)
+	}
+}
@@ -0,0 +1,178 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go-pkgdl/stats"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+//TopFailing number of failing paths listed in a report
+const TopFailing = 20
+
+//document what the JSON report holds, the run summary plus its duration in seconds
+type document struct {
+	stats.Summary
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+//Write the summary of a run as JSON, CSV and HTML files under dir, returning their paths
+func Write(dir string, summary stats.Summary) ([]string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	base := filepath.Join(dir, summary.Repo+"-"+summary.Start.Format("20060102-150405"))
+	writers := []struct {
+		ext   string
+		write func(*os.File, stats.Summary) error
+	}{
+		{".json", writeJSON},
+		{".csv", writeCSV},
+		{".html", writeHTML},
+	}
+	var paths []string
+	for _, w := range writers {
+		file, err := os.Create(base + w.ext)
+		if err != nil {
+			return paths, err
+		}
+		err = w.write(file, summary)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, base+w.ext)
+	}
+	return paths, nil
+}
+
+func writeJSON(file *os.File, summary stats.Summary) error {
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(document{Summary: summary, DurationSeconds: summary.Duration.Seconds()})
+}
+
+//statusCodes failure status codes in ascending order, 0 being failures without a response
+func statusCodes(summary stats.Summary) []int {
+	var codes []int
+	for code := range summary.FailedByStatus {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	return codes
+}
+
+func writeCSV(file *os.File, summary stats.Summary) error {
+	records := [][]string{
+		{"metric", "key", "value"},
+		{"repo", "", summary.Repo},
+		{"type", "", summary.Type},
+		{"start", "", summary.Start.Format("2006-01-02T15:04:05Z07:00")},
+		{"durationSeconds", "", strconv.FormatFloat(summary.Duration.Seconds(), 'f', 0, 64)},
+		{"discovered", "", strconv.FormatInt(summary.Discovered, 10)},
+		{"duplicates", "", strconv.FormatInt(summary.Duplicates, 10)},
+		{"done", "", strconv.FormatInt(summary.Done, 10)},
+		{"failed", "", strconv.FormatInt(summary.Failed, 10)},
+		{"retries", "", strconv.FormatInt(summary.Retries, 10)},
+		{"checksumFailed", "", strconv.FormatInt(summary.ChecksumFailed, 10)},
+		{"downloaded", "", strconv.FormatInt(summary.Downloaded, 10)},
+		{"cached", "", strconv.FormatInt(summary.Cached, 10)},
+		{"bytes", "", strconv.FormatInt(summary.Bytes, 10)},
+	}
+	for _, code := range statusCodes(summary) {
+		records = append(records, []string{"failedByStatus", strconv.Itoa(code), strconv.FormatInt(summary.FailedByStatus[code], 10)})
+	}
+	for _, failing := range summary.TopFailing {
+		records = append(records, []string{"topFailing", failing.Path, strconv.FormatInt(failing.Count, 10)})
+	}
+	for _, cred := range summary.Credentials {
+		records = append(records,
+			[]string{"credentialRequests", cred.Label, strconv.FormatInt(cred.Requests, 10)},
+			[]string{"credentialErrors", cred.Label, strconv.FormatInt(cred.Errors, 10)},
+			[]string{"credentialAuthFailures", cred.Label, strconv.FormatInt(cred.AuthFailures, 10)},
+			[]string{"credentialEjected", cred.Label, strconv.FormatBool(cred.Ejected)})
+	}
+	writer := csv.NewWriter(file)
+	writer.WriteAll(records)
+	return writer.Error()
+}
+
+//humanBytes byte count in the largest unit that keeps it above 1
+func humanBytes(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+var page = template.Must(template.New("report").Funcs(template.FuncMap{"bytes": humanBytes}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pkgdl report for {{.Repo}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+th { background: #eee; }
+</style>
+</head>
+<body>
+<h1>{{.Repo}} ({{.Type}})</h1>
+<p>Started {{.Start.Format "2006-01-02 15:04:05 MST"}}, ran for {{.Duration}}</p>
+<table>
+<tr><th>Discovered</th><td>{{.Discovered}}</td></tr>
+<tr><th>Duplicates suppressed</th><td>{{.Duplicates}}</td></tr>
+<tr><th>Done</th><td>{{.Done}}</td></tr>
+<tr><th>Failed</th><td>{{.Failed}}</td></tr>
+<tr><th>Requests retried</th><td>{{.Retries}}</td></tr>
+<tr><th>Checksum mismatches</th><td>{{.ChecksumFailed}}</td></tr>
+<tr><th>Artifacts downloaded</th><td>{{.Downloaded}}</td></tr>
+<tr><th>Artifacts already cached</th><td>{{.Cached}}</td></tr>
+<tr><th>Transferred</th><td>{{bytes .Bytes}}</td></tr>
+</table>
+{{if .Codes}}<h2>Failures by status</h2>
+<table>
+<tr><th>Status</th><th>Count</th></tr>
+{{range .Codes}}<tr><td>{{if .Code}}{{.Code}}{{else}}no response{{end}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{end}}{{if .TopFailing}}<h2>Top failing paths</h2>
+<table>
+<tr><th>Path</th><th>Failures</th></tr>
+{{range .TopFailing}}<tr><td>{{.Path}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{end}}{{if .Credentials}}<h2>Credentials</h2>
+<table>
+<tr><th>Credential</th><th>Requests</th><th>Errors</th><th>401/403</th><th>Ejected</th></tr>
+{{range .Credentials}}<tr><td>{{.Label}}</td><td>{{.Requests}}</td><td>{{.Errors}}</td><td>{{.AuthFailures}}</td><td>{{if .Ejected}}yes{{else}}no{{end}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+type statusCount struct {
+	Code  int
+	Count int64
+}
+
+func writeHTML(file *os.File, summary stats.Summary) error {
+	view := struct {
+		stats.Summary
+		Codes []statusCount
+	}{Summary: summary}
+	for _, code := range statusCodes(summary) {
+		view.Codes = append(view.Codes, statusCount{Code: code, Count: summary.FailedByStatus[code]})
+	}
+	return page.Execute(file, view)
+}
@@ -0,0 +1,72 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"go-pkgdl/stats"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	summary := stats.Summary{
+		Repo:           "npm-remote",
+		Type:           "npm",
+		Start:          time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		Duration:       90 * time.Second,
+		Discovered:     10,
+		Done:           7,
+		Failed:         3,
+		Downloaded:     5,
+		Cached:         2,
+		Bytes:          3 * 1024 * 1024,
+		FailedByStatus: map[int]int64{404: 2, 500: 1},
+		TopFailing:     []stats.PathCount{{Path: "/api/npm/npm-remote/<script>", Count: 2}},
+	}
+	paths, err := Write(dir, summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 3 || !strings.HasSuffix(paths[0], "npm-remote-20210304-050607.json") {
+		t.Fatalf("unexpected report files %v", paths)
+	}
+
+	data, _ := ioutil.ReadFile(paths[0])
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["durationSeconds"].(float64) != 90 || doc["cached"].(float64) != 2 {
+		t.Errorf("unexpected JSON report %s", data)
+	}
+
+	file, _ := os.Open(paths[1])
+	records, err := csv.NewReader(file).ReadAll()
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, record := range records {
+		if record[0] == "failedByStatus" && record[1] == "404" && record[2] == "2" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected 404 failures in CSV report, got %v", records)
+	}
+
+	html, _ := ioutil.ReadFile(paths[2])
+	if !strings.Contains(string(html), "3.0 MiB") || strings.Contains(string(html), "<script>") {
+		t.Errorf("expected escaped HTML report with human readable bytes, got %s", html)
+	}
+}
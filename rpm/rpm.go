@@ -1,11 +1,14 @@
 package rpm
 
 import (
-	"container/list"
+	"context"
+	"encoding/json"
+	"go-pkgdl/auth"
 	"go-pkgdl/helpers"
-	"net/http"
+	"go-pkgdl/journal"
+	"go-pkgdl/pkgtype"
+	"io"
 	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -18,14 +21,56 @@ type Metadata struct {
 	File string
 }
 
+//Key repository path of the RPM artifact
+func (md Metadata) Key() string {
+	return md.URL
+}
+
+//Plugin rpm package type
+type Plugin struct{}
+
+func init() {
+	pkgtype.Register("rpm", Plugin{})
+}
+
+//Crawl walk the upstream directory listing for rpms
+func (Plugin) Crawl(ctx context.Context, env pkgtype.Env, sink pkgtype.Sink) {
+	log.Info("rpm takes 10 seconds to init, please be patient")
+	//buggy. looks like there is a recursive search that screws it up
+	GetRpmHrefs(ctx, env.URL, env.Base, sink, env.Flags, env.Journal)
+}
+
+//Decode a Metadata journaled by an earlier run
+func (Plugin) Decode(data []byte) (interface{}, error) {
+	var md Metadata
+	err := json.Unmarshal(data, &md)
+	return md, err
+}
+
+//Fetch download the rpm
+func (Plugin) Fetch(ctx context.Context, env pkgtype.Env, item interface{}, workerNum int) error {
+	md := item.(Metadata)
+	return pkgtype.StandardDownload(ctx, env, md.URL, md.File, auth.Checksum{})
+}
+
 var junk int
 var junkUrls = make(map[string]int)
 
 //GetRpmHrefs parse hrefs for RPM files
-func GetRpmHrefs(url string, base string, RpmWorkerQueue *list.List, flags helpers.Flags) string {
-	resp, err := http.Get(url)
+func GetRpmHrefs(ctx context.Context, url string, base string, RpmWorkerQueue pkgtype.Sink, flags helpers.Flags, jrnl *journal.Journal) string {
+	if ctx.Err() != nil {
+		return ""
+	}
+	if jrnl.Visited(url) {
+		log.Debug("skipping ", url, ", already crawled")
+		return ""
+	}
+	resp, err := auth.Get(ctx, url)
 	// this needs to be threaded better..
 	helpers.Check(err, false, "HTTP GET error", helpers.Trace())
+	if err != nil {
+		return ""
+	}
 	defer resp.Body.Close()
 	log.Debug(resp) //output from HTML download
 
@@ -35,6 +80,9 @@ func GetRpmHrefs(url string, base string, RpmWorkerQueue *list.List, flags helpe
 		switch {
 		case tt == html.ErrorToken:
 			// End of the document, we're done
+			if z.Err() == io.EOF && ctx.Err() == nil {
+				jrnl.MarkVisited(url)
+			}
 			return ""
 		case tt == html.StartTagToken:
 			t := z.Token()
@@ -50,7 +98,7 @@ func GetRpmHrefs(url string, base string, RpmWorkerQueue *list.List, flags helpe
 							break
 						}
 
-						GetRpmHrefs(url+a.Val, base, RpmWorkerQueue, flags)
+						GetRpmHrefs(ctx, url+a.Val, base, RpmWorkerQueue, flags, jrnl)
 						break
 					}
 				}
@@ -69,7 +117,7 @@ func GetRpmHrefs(url string, base string, RpmWorkerQueue *list.List, flags helpe
 	}
 }
 
-func checkRpm(t html.Token, url string, base string, rpmWorkerQueue *list.List, flags helpers.Flags, junk int) int {
+func checkRpm(t html.Token, url string, base string, rpmWorkerQueue pkgtype.Sink, flags helpers.Flags, junk int) int {
 	log.Trace("received url token:", t.String())
 	if strings.Contains(t.String(), ".rpm") {
 		for _, a := range t.Attr {
@@ -83,13 +131,7 @@ func checkRpm(t html.Token, url string, base string, rpmWorkerQueue *list.List,
 				var RpmMd Metadata
 				RpmMd.URL = strings.TrimPrefix(href, "/centos")
 				RpmMd.File = a.Val
-				rpmWorkerQueue.PushBack(RpmMd)
-
-				for rpmWorkerQueue.Len() > flags.SleepQueueMaxVar {
-					log.Info("RPM worker queue is at ", rpmWorkerQueue.Len(), ", queue max is set to ", flags.SleepQueueMaxVar, ", sleeping for ", flags.WorkerSleepVar, " seconds...")
-					time.Sleep(time.Duration(flags.WorkerSleepVar) * time.Second)
-				}
-				log.Trace("Queue at:", rpmWorkerQueue.Len(), ", resuming RPM worker queue")
+				rpmWorkerQueue.Push(RpmMd)
 				break
 			}
 		}
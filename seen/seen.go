@@ -0,0 +1,140 @@
+package seen
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+//Set concurrency safe, memory bounded set of the package identities seen during a run.
+//Only a 64 bit hash of every identity is kept, and once max identities are held the oldest are forgotten.
+//hashes maps every remembered identity to its slot in order, a slot whose identity was forgotten or re-added is stale
+type Set struct {
+	mu     sync.Mutex
+	hashes map[uint64]int
+	order  []uint64
+	next   int
+	max    int
+}
+
+//New create a set remembering at most max identities. max < 1 means unbounded
+func New(max int) *Set {
+	return &Set{hashes: make(map[uint64]int), max: max}
+}
+
+//Normalize identity of a package, so the same package found through different searches compares equal.
+//Case is kept, repository paths are case sensitive, plugins whose names aren't lowercase them in their Key
+func Normalize(key string) string {
+	return strings.TrimSuffix(strings.TrimSpace(key), "/")
+}
+
+func hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(Normalize(key)))
+	return h.Sum64()
+}
+
+//Add remember key, returning false if it was already seen
+func (s *Set) Add(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(hash(key))
+}
+
+func (s *Set) add(h uint64) bool {
+	if _, ok := s.hashes[h]; ok {
+		return false
+	}
+	if s.max > 0 && len(s.order) == s.max {
+		//forget the oldest identity to make room, unless its slot is stale
+		if s.live(s.next) {
+			delete(s.hashes, s.order[s.next])
+		}
+		s.order[s.next] = h
+		s.hashes[h] = s.next
+		s.next = (s.next + 1) % s.max
+	} else {
+		s.order = append(s.order, h)
+		s.hashes[h] = len(s.order) - 1
+	}
+	return true
+}
+
+//live whether the identity in slot i is still remembered there
+func (s *Set) live(i int) bool {
+	slot, ok := s.hashes[s.order[i]]
+	return ok && slot == i
+}
+
+//Forget key, so it is queued again if found later in the run. Its slot turns stale and is reused once it is the oldest
+func (s *Set) Forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.hashes, hash(key))
+}
+
+//Len number of identities remembered
+func (s *Set) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.hashes)
+}
+
+//Load identities saved by an earlier run. A missing file is not an error
+func (s *Set) Load(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reader := bufio.NewReader(file)
+	buf := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			//a short last record from a killed run is dropped
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
+		}
+		s.add(binary.LittleEndian.Uint64(buf))
+	}
+}
+
+//Save the identities, oldest first, so the next run can Load them
+func (s *Set) Save(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+
+	s.mu.Lock()
+	buf := make([]byte, 8)
+	for i := range s.order {
+		slot := (s.next + i) % len(s.order)
+		if !s.live(slot) {
+			continue
+		}
+		h := s.order[slot]
+		binary.LittleEndian.PutUint64(buf, h)
+		writer.Write(buf)
+	}
+	s.mu.Unlock()
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
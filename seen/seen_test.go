@@ -0,0 +1,113 @@
+package seen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetAdd(t *testing.T) {
+	s := New(0)
+	if !s.Add("react") {
+		t.Error("expected first add to be new")
+	}
+	if s.Add(" react/") {
+		t.Error("expected normalized duplicate to be suppressed")
+	}
+	if !s.Add("org/Foo/foo-1.0.jar") || !s.Add("org/foo/foo-1.0.jar") {
+		t.Error("expected paths differing in case to be different packages")
+	}
+	if !s.Add("react-dom") {
+		t.Error("expected different package to be new")
+	}
+	if s.Len() != 4 {
+		t.Errorf("expected 4 identities, got %d", s.Len())
+	}
+	s.Forget("react/")
+	if !s.Add("react") {
+		t.Error("expected forgotten identity to be new again")
+	}
+}
+
+func TestSetBounded(t *testing.T) {
+	s := New(2)
+	s.Add("a")
+	s.Add("b")
+	s.Add("c")
+	if s.Len() != 2 {
+		t.Fatalf("expected set to hold 2 identities, got %d", s.Len())
+	}
+	if s.Add("c") || s.Add("b") {
+		t.Error("expected newest identities to be remembered")
+	}
+	if !s.Add("a") {
+		t.Error("expected oldest identity to be forgotten")
+	}
+}
+
+func TestSetPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "npm-remote.seen")
+
+	s := New(2)
+	s.Add("a")
+	s.Add("b")
+	s.Add("c")
+	if err := s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := New(2)
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Add("b") || loaded.Add("c") {
+		t.Error("expected saved identities to be loaded")
+	}
+	if !loaded.Add("a") {
+		t.Error("expected forgotten identity to stay forgotten")
+	}
+	if err := New(0).Load(filepath.Join(dir, "missing.seen")); err != nil {
+		t.Error("expected a missing file to load as empty, got ", err)
+	}
+}
+
+func TestSetForgetThenAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pypi-remote.seen")
+
+	s := New(3)
+	s.Add("a")
+	s.Add("b")
+	s.Add("c")
+	s.Forget("a")
+	s.Add("a")
+	s.Add("d")
+	//b was the oldest left once a was forgotten and added again
+	if !s.Add("b") {
+		t.Error("expected oldest identity to be evicted")
+	}
+	if s.Add("a") || s.Add("d") {
+		t.Error("expected re-added identity not to be evicted in place of a stale slot")
+	}
+	s.Forget("d")
+	if err := s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 2*8 {
+		t.Errorf("expected 2 identities saved, got %d bytes", info.Size())
+	}
+}
@@ -0,0 +1,235 @@
+package stats
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//maxFailingPaths caps how many distinct failing paths are tallied, so a run failing everything stays bounded
+const maxFailingPaths = 10000
+
+//Summary tally of a run
+type Summary struct {
+	Repo           string        `json:"repo"`
+	Type           string        `json:"type"`
+	Start          time.Time     `json:"start"`
+	Duration       time.Duration `json:"-"`
+	Discovered     int64         `json:"discovered"`
+	Duplicates     int64         `json:"duplicates"`
+	Done           int64         `json:"done"`
+	Failed         int64         `json:"failed"`
+	AuthFailed     int64         `json:"authFailed"`
+	Retries        int64         `json:"retries"`
+	ChecksumFailed int64         `json:"checksumFailed"`
+	Downloaded     int64         `json:"downloaded"`
+	Cached         int64         `json:"cached"`
+	Bytes          int64         `json:"bytes"`
+	FailedByStatus map[int]int64 `json:"failedByStatus"`
+	TopFailing     []PathCount   `json:"topFailing"`
+	//Credentials usage of each -credsfile credential, by label
+	Credentials []CredentialCount `json:"credentials,omitempty"`
+}
+
+//CredentialCount requests made with one credential
+type CredentialCount struct {
+	Label        string `json:"label"`
+	Requests     int64  `json:"requests"`
+	Errors       int64  `json:"errors"`
+	AuthFailures int64  `json:"authFailures"`
+	Ejected      bool   `json:"ejected"`
+}
+
+//PathCount number of failures of one path
+type PathCount struct {
+	Path  string `json:"path"`
+	Count int64  `json:"count"`
+}
+
+//statusCoder errors carrying the HTTP status code of a failed request, such as *auth.StatusError
+type statusCoder interface {
+	Status() (path string, code int)
+}
+
+//checksumMismatch errors of downloads that didn't match their checksum, such as *auth.ChecksumError
+type checksumMismatch interface {
+	Mismatch() (path string)
+}
+
+type run struct {
+	repo, pkgType  string
+	start          time.Time
+	discovered     int64
+	duplicates     int64
+	done           int64
+	failed         int64
+	authFailed     int64
+	retries        int64
+	checksumFailed int64
+	downloaded     int64
+	cached         int64
+	bytes          int64
+
+	mu          sync.Mutex
+	byStatus    map[int]int64
+	failing     map[string]int64
+	credentials map[string]*CredentialCount
+}
+
+var current = newRun()
+
+func newRun() *run {
+	return &run{start: time.Now(), byStatus: make(map[int]int64), failing: make(map[string]int64), credentials: make(map[string]*CredentialCount)}
+}
+
+//SetRun name the repository and package type the run is for
+func SetRun(repo string, pkgType string) {
+	current.mu.Lock()
+	defer current.mu.Unlock()
+	current.repo = repo
+	current.pkgType = pkgType
+}
+
+//Discovered count an item queued by a crawler
+func Discovered() {
+	atomic.AddInt64(&current.discovered, 1)
+}
+
+//Duplicate count an item suppressed because it was already queued this run
+func Duplicate() {
+	atomic.AddInt64(&current.duplicates, 1)
+}
+
+//Cached count an artifact skipped because the remote's cache already has it
+func Cached() {
+	atomic.AddInt64(&current.cached, 1)
+}
+
+//Downloaded count an artifact pulled through the remote
+func Downloaded() {
+	atomic.AddInt64(&current.downloaded, 1)
+}
+
+//Transferred count bytes received
+func Transferred(n int64) {
+	atomic.AddInt64(&current.bytes, n)
+}
+
+//Retried count a request retried by the retry policy
+func Retried() {
+	atomic.AddInt64(&current.retries, 1)
+}
+
+//credential the tally of label, callers hold current.mu
+func credential(label string) *CredentialCount {
+	count, ok := current.credentials[label]
+	if !ok {
+		count = &CredentialCount{Label: label}
+		current.credentials[label] = count
+	}
+	return count
+}
+
+//CredentialUsed count a request made with the credential label. Requests that got no response or a status of 400 and up are errors
+func CredentialUsed(label string, statusCode int, err error) {
+	current.mu.Lock()
+	defer current.mu.Unlock()
+	count := credential(label)
+	count.Requests++
+	if err != nil || statusCode >= 400 {
+		count.Errors++
+	}
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+		count.AuthFailures++
+	}
+}
+
+//CredentialEjected note the credential label is no longer used
+func CredentialEjected(label string) {
+	current.mu.Lock()
+	defer current.mu.Unlock()
+	credential(label).Ejected = true
+}
+
+//Finished count the outcome of a fetched item
+func Finished(err error) {
+	if err == nil {
+		atomic.AddInt64(&current.done, 1)
+		return
+	}
+	atomic.AddInt64(&current.failed, 1)
+	path, code := "", 0
+	var statusErr statusCoder
+	var mismatch checksumMismatch
+	if errors.As(err, &mismatch) {
+		atomic.AddInt64(&current.checksumFailed, 1)
+		path = mismatch.Mismatch()
+	} else if errors.As(err, &statusErr) {
+		path, code = statusErr.Status()
+	}
+	if code == http.StatusUnauthorized || code == http.StatusForbidden {
+		atomic.AddInt64(&current.authFailed, 1)
+	}
+
+	current.mu.Lock()
+	defer current.mu.Unlock()
+	if mismatch == nil {
+		current.byStatus[code]++
+	}
+	if path == "" {
+		return
+	}
+	if _, ok := current.failing[path]; ok || len(current.failing) < maxFailingPaths {
+		current.failing[path]++
+	}
+}
+
+//Snapshot current tally of the run, with up to top of its most failing paths
+func Snapshot(top int) Summary {
+	summary := Summary{
+		Start:          current.start,
+		Duration:       time.Since(current.start),
+		Discovered:     atomic.LoadInt64(&current.discovered),
+		Duplicates:     atomic.LoadInt64(&current.duplicates),
+		Done:           atomic.LoadInt64(&current.done),
+		Failed:         atomic.LoadInt64(&current.failed),
+		AuthFailed:     atomic.LoadInt64(&current.authFailed),
+		Retries:        atomic.LoadInt64(&current.retries),
+		ChecksumFailed: atomic.LoadInt64(&current.checksumFailed),
+		Downloaded:     atomic.LoadInt64(&current.downloaded),
+		Cached:         atomic.LoadInt64(&current.cached),
+		Bytes:          atomic.LoadInt64(&current.bytes),
+		FailedByStatus: make(map[int]int64),
+	}
+
+	current.mu.Lock()
+	defer current.mu.Unlock()
+	summary.Repo = current.repo
+	summary.Type = current.pkgType
+	for code, count := range current.byStatus {
+		summary.FailedByStatus[code] = count
+	}
+	for _, count := range current.credentials {
+		summary.Credentials = append(summary.Credentials, *count)
+	}
+	sort.Slice(summary.Credentials, func(i, j int) bool { return summary.Credentials[i].Label < summary.Credentials[j].Label })
+	if top < 1 {
+		return summary
+	}
+	for path, count := range current.failing {
+		summary.TopFailing = append(summary.TopFailing, PathCount{Path: path, Count: count})
+	}
+	sort.Slice(summary.TopFailing, func(i, j int) bool {
+		if summary.TopFailing[i].Count != summary.TopFailing[j].Count {
+			return summary.TopFailing[i].Count > summary.TopFailing[j].Count
+		}
+		return summary.TopFailing[i].Path < summary.TopFailing[j].Path
+	})
+	if len(summary.TopFailing) > top {
+		summary.TopFailing = summary.TopFailing[:top]
+	}
+	return summary
+}
@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+//Direct proxy setting that bypasses any proxy, including the environment's
+const Direct = "direct"
+
+//proxySchemes proxy URLs the transport knows how to talk through
+var proxySchemes = map[string]bool{"http": true, "https": true, "socks5": true}
+
+//Proxies picks the proxy of a request depending on whether it goes to Artifactory or to an upstream host
+type Proxies struct {
+	artifactory func(*url.URL) (*url.URL, error)
+	upstream    func(*url.URL) (*url.URL, error)
+
+	mu              sync.RWMutex
+	artifactoryHost string
+}
+
+//NewProxies route Artifactory requests through artifactory and every other request through upstream.
+//Both are http://, https:// or socks5:// URLs, Direct, or empty for the environment's HTTP_PROXY/HTTPS_PROXY.
+//noProxy is a NO_PROXY style list of hosts reached without a proxy on both sides, empty for the environment's NO_PROXY
+func NewProxies(artifactory string, upstream string, noProxy string) (*Proxies, error) {
+	artifactoryFunc, err := proxyFunc(artifactory, noProxy)
+	if err != nil {
+		return nil, fmt.Errorf("Artifactory proxy: %v", err)
+	}
+	upstreamFunc, err := proxyFunc(upstream, noProxy)
+	if err != nil {
+		return nil, fmt.Errorf("upstream proxy: %v", err)
+	}
+	return &Proxies{artifactory: artifactoryFunc, upstream: upstreamFunc}, nil
+}
+
+func proxyFunc(proxy string, noProxy string) (func(*url.URL) (*url.URL, error), error) {
+	config := httpproxy.FromEnvironment()
+	if noProxy != "" {
+		config.NoProxy = noProxy
+	}
+	switch proxy {
+	case "":
+	case Direct:
+		return func(*url.URL) (*url.URL, error) { return nil, nil }, nil
+	default:
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		if !proxySchemes[proxyURL.Scheme] || proxyURL.Host == "" {
+			return nil, fmt.Errorf("%s is not an http://, https:// or socks5:// proxy URL", proxy)
+		}
+		config.HTTPProxy = proxy
+		config.HTTPSProxy = proxy
+	}
+	return config.ProxyFunc(), nil
+}
+
+//SetArtifactory the Artifactory URL, whose host gets the Artifactory proxy
+func (p *Proxies) SetArtifactory(urlInput string) {
+	parsed, err := url.Parse(urlInput)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.artifactoryHost = parsed.Host
+	p.mu.Unlock()
+}
+
+//Proxy for http.Transport
+func (p *Proxies) Proxy(req *http.Request) (*url.URL, error) {
+	p.mu.RLock()
+	artifactory := strings.EqualFold(req.URL.Host, p.artifactoryHost)
+	p.mu.RUnlock()
+	if artifactory {
+		return p.artifactory(req.URL)
+	}
+	return p.upstream(req.URL)
+}
@@ -0,0 +1,37 @@
+package transport
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProxies(t *testing.T) {
+	proxies, err := NewProxies(Direct, "socks5://egress.example.com:1080", "mirror.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies.SetArtifactory("https://artifactory.example.com/artifactory")
+
+	for target, want := range map[string]string{
+		"https://artifactory.example.com/artifactory/api/system/ping": "",
+		"https://pypi.org/simple/":                                    "socks5://egress.example.com:1080",
+		"http://mirror.internal/debian/":                              "",
+	} {
+		req, _ := http.NewRequest("GET", target, nil)
+		proxy, err := proxies.Proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != want {
+			t.Errorf("expected %s to go through %q, got %q", target, want, got)
+		}
+	}
+
+	if _, err := NewProxies("ftp://proxy.example.com", "", ""); err == nil {
+		t.Error("expected an unsupported proxy scheme to be rejected")
+	}
+}
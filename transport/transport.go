@@ -0,0 +1,196 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+//Options tuning of the transport every request goes through. A zero timeout means no limit
+type Options struct {
+	//MaxConnsIdle idle connections kept per host, sized to the number of workers so they are reused instead of redialed
+	MaxConnsIdle   int
+	HTTP2          bool
+	ConnectTimeout time.Duration
+	TLSTimeout     time.Duration
+	HeaderTimeout  time.Duration
+	IdleTimeout    time.Duration
+	//Timeout overall limit for a request, including reading its body
+	Timeout time.Duration
+	//StallTimeout how long reading a body may go without receiving a byte before the request is aborted
+	StallTimeout time.Duration
+	//TLS used against Artifactory and upstream hosts alike, nil for the defaults
+	TLS *tls.Config
+	//Proxy picks the proxy of a request, nil for the environment's
+	Proxy func(*http.Request) (*url.URL, error)
+}
+
+//keepAlive TCP keep-alive period of dialed connections
+const keepAlive = 30 * time.Second
+
+//New the shared http.RoundTripper tuned with opts
+func New(opts Options) http.RoundTripper {
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout, KeepAlive: keepAlive}
+	proxy := opts.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	base := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     opts.HTTP2,
+		MaxIdleConns:          2 * opts.MaxConnsIdle,
+		MaxIdleConnsPerHost:   opts.MaxConnsIdle,
+		IdleConnTimeout:       opts.IdleTimeout,
+		TLSHandshakeTimeout:   opts.TLSTimeout,
+		ResponseHeaderTimeout: opts.HeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       opts.TLS,
+	}
+	if !opts.HTTP2 {
+		//a non nil, empty TLSNextProto is how net/http is told not to negotiate HTTP/2
+		base.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &Watchdog{Base: base, Timeout: opts.Timeout, StallTimeout: opts.StallTimeout}
+}
+
+//tlsVersions accepted by TLSConfig's minVersion
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//TLSConfig trusting the certificates in caFile on top of the system's, presenting the client certificate in certFile/keyFile if set,
+//and refusing TLS versions below minVersion (1.0, 1.1, 1.2 or 1.3). insecure skips verifying the server's certificate altogether
+func TLSConfig(caFile, certFile, keyFile, minVersion string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", minVersion)
+		}
+		config.MinVersion = version
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("a client certificate needs both a certificate and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+//StallError a body that stopped receiving data for longer than the stall timeout
+type StallError struct {
+	URL     string
+	Timeout time.Duration
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("%s stalled, nothing received for %v", e.URL, e.Timeout)
+}
+
+//Watchdog http.RoundTripper aborting requests that run past Timeout, or whose body stalls for StallTimeout
+type Watchdog struct {
+	Base         http.RoundTripper
+	Timeout      time.Duration
+	StallTimeout time.Duration
+}
+
+//RoundTrip implements http.RoundTripper
+func (w *Watchdog) RoundTrip(req *http.Request) (*http.Response, error) {
+	if w.Timeout <= 0 && w.StallTimeout <= 0 {
+		return w.Base.RoundTrip(req)
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if w.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), w.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(req.Context())
+	}
+	resp, err := w.Base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body := &watchedBody{ReadCloser: resp.Body, cancel: cancel, url: req.URL.String(), stallTimeout: w.StallTimeout}
+	if w.StallTimeout > 0 {
+		body.timer = time.AfterFunc(w.StallTimeout, body.stall)
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+//watchedBody cancels its request once Close is called, or when no data arrives for stallTimeout
+type watchedBody struct {
+	io.ReadCloser
+	cancel       context.CancelFunc
+	url          string
+	stallTimeout time.Duration
+	timer        *time.Timer
+
+	mu      sync.Mutex
+	stalled bool
+}
+
+func (b *watchedBody) stall() {
+	b.mu.Lock()
+	b.stalled = true
+	b.mu.Unlock()
+	b.cancel()
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.timer != nil && n > 0 {
+		b.timer.Reset(b.stallTimeout)
+	}
+	if err != nil && err != io.EOF {
+		b.mu.Lock()
+		stalled := b.stalled
+		b.mu.Unlock()
+		if stalled {
+			err = &StallError{URL: b.url, Timeout: b.stallTimeout}
+		}
+	}
+	return n, err
+}
+
+func (b *watchedBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,101 @@
+package transport
+
+import (
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStalledBody(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := &http.Client{Transport: New(Options{MaxConnsIdle: 2, HTTP2: true, StallTimeout: 100 * time.Millisecond})}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	start := time.Now()
+	data, err := ioutil.ReadAll(resp.Body)
+	var stall *StallError
+	if !errors.As(err, &stall) {
+		t.Fatalf("expected a stall error, got %v", err)
+	}
+	if string(data) != "partial" {
+		t.Errorf("expected the data received before the stall, got %q", data)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("expected the stalled read to be aborted")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: New(Options{Timeout: 100 * time.Millisecond})}
+	start := time.Now()
+	if _, err := client.Get(server.URL); err == nil {
+		t.Error("expected the request to time out")
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Error("expected the request to be aborted after the overall timeout")
+	}
+}
+
+func TestTLSConfigCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&http.Client{Transport: New(Options{})}).Get(server.URL); err == nil {
+		t.Error("expected the internal CA not to be trusted by default")
+	}
+	config, err := TLSConfig(caFile, "", "", "1.2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: New(Options{TLS: config})}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected the CA bundle to be trusted, got %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := TLSConfig("", "", "", "1.4", false); err == nil {
+		t.Error("expected an unknown TLS version to be rejected")
+	}
+	if _, err := TLSConfig("", caFile, "", "", false); err == nil {
+		t.Error("expected a client certificate without a key to be rejected")
+	}
+}